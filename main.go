@@ -3,18 +3,40 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"io/ioutil"
 	"strings"
-	"log"
+	"log/slog"
 	"strconv"
 	"sync"
 	"time"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/sha512"
 	"encoding/base64"
 	"os"
 	"os/signal"
 	"syscall"
 	"flag"
+	"net"
+	"io"
+	"mime"
+	"net/url"
+	"errors"
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+	"crypto/hmac"
+	"crypto/sha256"
+	"context"
+	"compress/gzip"
+	"container/list"
+	"sync/atomic"
+	"math"
+	"sort"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //
@@ -26,285 +48,3951 @@ import (
 
 type PasswordManagerInterface interface {
 	Hash(pwd string) int64
-	Get(id int64) []byte
+	HashWithDelay(pwd string, nap time.Duration) int64
+	HashCtx(ctx context.Context, pwd string) (int64, error)
+	HashIdempotent(ctx context.Context, key string, pwd string) (int64, bool, error)
+	HashBatch(pwds []string) ([]int64, error)
+	Get(id int64) ([]byte, TaskState)
+	Peek(id int64) ([]byte, bool)
+	Delete(id int64) bool
+	Verify(id int64, candidate string) (bool, error)
+	VerifyHash(candidate string, pwdHash []byte) (bool, error)
+	PendingPolls(id int64) int
+	State(id int64) TaskState
+	ExpiresAt(id int64) time.Time
 	Stats() (int64, int64)
+	StatsDetailed() DetailedStats
+	Quantiles(qs []float64) []time.Duration
+	ApproxStats() (int64, int64)
+	ResetStats()
+	BudgetExceeded() bool
+	ResetBudget()
+	Throughput() float64
+	UnretrievedCount() int
+	PendingCount() int
 	HasPendingHashes() bool
+	IsSaturated() bool
+	StoreError() error
+	Drained() <-chan struct{}
+	DrainAll(ctx context.Context) map[int64][]byte
+	Export() TaskExport
+	Import(export TaskExport) error
 	Shutdown()
 	IsShuttingDown() bool
+	SetMaintenance(on bool)
+	IsInMaintenance() bool
 }
 
+// State of a task ... lets the handler tell clients why a hash isn't available
+type TaskState int
+
+const (
+	TaskUnknown TaskState = iota // id was never handed out
+	TaskPending                  // hash is still being calculated
+	TaskReady                    // hash can be retrieved
+	TaskGone                     // hash was already retrieved
+	TaskFailed                   // hash couldn't be calculated
+	TaskCancelled                // context of the hash was cancelled before it was calculated
+	TaskDeleted                  // hash was discarded without being retrieved
+)
+
 //
 // Concrete service
 //
 type PasswordManager struct {
 	sync.Mutex
-	tasks map[int64][]byte		// hash results, indexed by id
-								// in real life, this should be a bounded map to avoid OOM
+	tasks map[int64]storedHash	// hash results, indexed by id
+	lru *list.List              // ids in tasks, most recently used first
+	lruElems map[int64]*list.Element // element of each id in lru
+	maxEntries int              // tasks holds at most this many hashes, evicting the least recently used; <= 0 is unbounded
+	pending map[int64]bool      // ids of hashes that are still being calculated
+	failed map[int64]bool       // ids of hashes whose calculation failed
+	cancelled map[int64]bool    // ids of hashes whose context was cancelled
+	deleted map[int64]bool      // ids of hashes discarded by Delete
+	markers *list.List          // ids in failed, cancelled and deleted whose calculation ended, oldest first; see addMarker
+	polls map[int64]int         // number of Get calls per id while it was still pending
+	verifyFailures map[int64]int // failed Verify calls per id in tasks, see MaxVerifyFailures
+	keys map[string]int64       // id started for each idempotency key, see HashIdempotent
 	id int64 					// next task id
 	requests int64       		// number of processed hash requests
 	totalTime time.Duration     // total time spent processing requests
-	pendingHashes int           // currently pending hash requests
-	shuttingDown bool 			// indicates that a shutdown is in progress
+	pendingHashes int64         // currently pending hash requests; atomic, so that checking it never waits for the lock
+	shuttingDown int32 			// 1 if a shutdown is in progress; atomic so that checking it never waits for the lock
+	wg sync.WaitGroup           // running calculateHash goroutines
+	drained chan struct{}       // closed once a shutdown is in progress and no hashes are pending
+	shutdownOnce sync.Once      // runs the parts of Shutdown that can't be repeated
+	entryTTL time.Duration      // unretrieved hashes expire after this long; 0 keeps them
+	quit chan struct{}          // closed on shutdown to stop the cleanup goroutine
+	cleanupDone chan struct{}   // closed once the cleanup goroutine stopped
+	maintenance int32           // 1 if API requests are rejected for planned maintenance; atomic as well
+	now func() time.Time        // clock used for timing; replaceable for tests
+	nap time.Duration           // simulated processing delay of Hash
+	hasher func(Algorithm, HashParams, string, []byte) (storedHash, error) // hashPassword; replaceable for tests
+	workerPool chan struct{}    // semaphore with a slot per concurrent hash; nil is unlimited
+	store Store                 // optional; completed hashes and ids survive restarts, see Restore
+	storeErr error              // result of the latest store write
+	reservedID int64            // ids below were reserved in store
+	metrics *Metrics            // optional; Prometheus metrics, see WithMetrics
+	completions []time.Time     // completion times within the throughput window, oldest first
+	durations []time.Duration   // durations of the latest MaxDurationSamples hashes, a ring buffer
+	nextDuration int            // position of the next duration in durations once it's full
+	minTime, maxTime time.Duration // shortest and longest duration since the last reset
+	resets int64                // number of ResetStats calls, tells consumers of Total that it restarted
+	evicted int64               // unretrieved hashes evicted for new ones since the last reset
+	ThroughputWindow time.Duration // rolling window for Throughput(); set before use
+	approxRequests int64        // copies of requests and totalTime (ns) for ApproxStats; atomic
+	approxTotalTime int64
+	Algorithm Algorithm         // hash algorithm; set before use
+	Params HashParams           // cost parameters for the algorithm; set before use
+	CPUBudget time.Duration     // total time hashing may take before new hashes are rejected; 0 is unlimited
+	cpuTime time.Duration       // time spent hashing (without the nap) since the last budget reset
 }
 
 const (
-	NapTimeSec = 5*time.Second // simulates 5s processing delay
+	NapTimeSec = 5*time.Second // default of the simulated processing delay; see WithNap
+	DefaultThroughputWindow = 1*time.Minute
+	MaxBodyBytes = 4096        // hash requests are tiny; larger bodies are rejected
+	VerifyBodyOverhead = 4096  // bytes besides the password in verify bodies: JSON, an id and a base64 hash or tag
+	MaxImportBytes = 64<<20    // POST /admin/import bodies; fits an export of DefaultMaxEntries hashes
+	MaxBatchSize = 100         // passwords per POST /hash/batch; a batch can't be larger than -workers either
+	MaxIdempotencyKeyBytes = 255 // longer Idempotency-Key headers are rejected
+	DefaultMaxEntries = 100000 // unretrieved hashes kept before the least recently used are evicted
+	DefaultWorkers = 64        // hashes calculated concurrently before Hash refuses new ones
+	MaxDurationSamples = 1000  // latest durations kept for the percentiles in StatsDetailed
+	DefaultEntryTTL = 1*time.Hour // unretrieved hashes expire after this long; see WithEntryTTL
+	CleanupInterval = 1*time.Minute // time between two removals of expired hashes
+	StoreReserveBlock = 1000   // ids reserved in a store at once; a restart skips the unused rest of the block
+	MaxQuantiles = 20          // quantiles per GET /stats?quantiles=
+	MaxVerifyFailures = 5      // failed Verify calls per hash before it refuses to check more passwords
 )
 
+// Ids returned by Hash when it refuses a hash
+const (
+	HashBusy int64 = -1          // all workers are busy
+	HashShuttingDown int64 = -2  // a shutdown is in progress
+)
+
+// Hash result of a task
+type storedHash struct {
+	salt []byte                 // per password random salt; nil if the hash embeds its own (bcrypt, scrypt, argon2id)
+	hash []byte                 // version byte followed by the digest or the algorithm's encoding
+	expiresAt time.Time         // when the unretrieved hash is removed; zero never
+}
+
+// Why there's no hash for a task, see addMarker
+type marker struct {
+	id int64
+	at time.Time                // when the calculation ended or the hash was deleted
+}
+
+// Returns the hash as Get returns it: version || salt || digest for sha512, the hash itself otherwise
+func (sh storedHash) bytes() []byte {
+	if sh.salt == nil {
+		return sh.hash
+	}
+
+	b := make([]byte, 0, len(sh.hash)+len(sh.salt))
+	b = append(b, sh.hash[0])
+	b = append(b, sh.salt...)
+
+	return append(b, sh.hash[1:]...)
+}
+
+// Optional setting for the constructors
+type Option func(*PasswordManager)
+
+// Sets the simulated processing delay of Hash; NapTimeSec by default
+func WithNap(nap time.Duration) Option {
+	return func(pm *PasswordManager) {
+		pm.nap = nap
+	}
+}
+
+// Sets how long unretrieved hashes are kept; DefaultEntryTTL by default, 0 keeps them until they're evicted
+func WithEntryTTL(ttl time.Duration) Option {
+	return func(pm *PasswordManager) {
+		pm.entryTTL = ttl
+	}
+}
+
+// Records Prometheus metrics of the hashes; managers of all tenants can share one
+func WithMetrics(m *Metrics) Option {
+	return func(pm *PasswordManager) {
+		pm.metrics = m
+	}
+}
+
+// Inverse of bytes()
+func parseStoredHash(b []byte) storedHash {
+	if salt, hash, err := SplitSaltAndHash(b); err == nil {
+		return storedHash{salt: salt, hash: append([]byte{b[0]}, hash...)}
+	}
+
+	return storedHash{hash: b}
+}
+
 // Constructor
-func NewPasswordManager() (* PasswordManager) {
-	return &PasswordManager{tasks: make(map[int64][]byte)}
+func NewPasswordManager(opts ...Option) (* PasswordManager) {
+	return NewPasswordManagerWithOptions(DefaultMaxEntries, DefaultWorkers, opts...)
+}
+
+// Constructor for a manager holding at most maxEntries unretrieved hashes
+//   - workers > 0 caps the number of hashes calculated concurrently; Hash returns -1 once they're all busy
+func NewPasswordManagerWithOptions(maxEntries int, workers int, opts ...Option) (* PasswordManager) {
+	pm := &PasswordManager{tasks: make(map[int64]storedHash), lru: list.New(), lruElems: make(map[int64]*list.Element),
+		maxEntries: maxEntries, pending: make(map[int64]bool), failed: make(map[int64]bool),
+		cancelled: make(map[int64]bool), deleted: make(map[int64]bool), markers: list.New(),
+		polls: make(map[int64]int), verifyFailures: make(map[int64]int), keys: make(map[string]int64), drained: make(chan struct{}), now: time.Now, entryTTL: DefaultEntryTTL,
+		quit: make(chan struct{}), cleanupDone: make(chan struct{}), hasher: hashPassword, nap: NapTimeSec,
+		ThroughputWindow: DefaultThroughputWindow, Algorithm: SHA512, Params: DefaultHashParams}
+
+	if workers > 0 {
+		pm.workerPool = make(chan struct{}, workers)
+	}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	go pm.cleanup(CleanupInterval)
+
+	return pm
+}
+
+// Periodically removes expired hashes until the shutdown
+func (pm *PasswordManager) cleanup(interval time.Duration) {
+	defer close(pm.cleanupDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pm.Lock()
+			pm.expireTasks()
+			pm.expireMarkers()
+			pm.expireKeys()
+			pm.Unlock()
+		case <-pm.quit:
+			return
+		}
+	}
+}
+
+// Removes all expired hashes; needs the lock
+//   - an expired hash looks like it was already retrieved, just like an evicted one
+func (pm *PasswordManager) expireTasks() {
+	for id := range pm.tasks {
+		pm.expireTask(id)
+	}
+}
+
+// Removes hash id if it expired; needs the lock
+func (pm *PasswordManager) expireTask(id int64) {
+	pwdHash, ok := pm.tasks[id]
+	if ok && !pwdHash.expiresAt.IsZero() && !pm.now().Before(pwdHash.expiresAt) {
+		pm.removeTask(id)
+		delete(pm.polls, id)
+	}
+}
+
+// Drops the markers older than the entry TTL; needs the lock
+func (pm *PasswordManager) expireMarkers() {
+	for pm.entryTTL > 0 && pm.markers.Len() > 0 {
+		oldest := pm.markers.Front()
+		if pm.now().Before(oldest.Value.(marker).at.Add(pm.entryTTL)) {
+			return
+		}
+		pm.dropMarker(oldest)
+	}
+}
+
+// Forgets the idempotency keys whose hash is neither pending nor ready anymore; needs the lock
+func (pm *PasswordManager) expireKeys() {
+	for key, id := range pm.keys {
+		if state := pm.state(id); state != TaskPending && state != TaskReady {
+			delete(pm.keys, key)
+		}
+	}
 }
 
 // Start hash, returns task id
 func (pm *PasswordManager) Hash(pwd string) int64 {
-	ts := time.Now() // spec didn't say if time keeping should include the 5s nap time; here it's calculated for the
+	id, _ := pm.HashCtx(context.Background(), pwd)
+	return id
+}
+
+// Start hash that is abandoned if ctx is done before it's calculated, returns task id
+//   - a cancelled hash is removed without a result, its id stays TaskCancelled
+func (pm *PasswordManager) HashCtx(ctx context.Context, pwd string) (int64, error) {
+	return pm.hashWithContext(ctx, pwd, pm.nap)
+}
+
+// Start hash unless one was already started with the same idempotency key, returns task id and whether
+// it's the id of the earlier hash
+//   - the key is tracked as long as its hash is pending or ready; once it's retrieved, deleted, expired,
+//     cancelled or failed the key is forgotten and the next call starts a new hash
+//   - only the key is compared, a repeat with another password still gets the earlier id
+func (pm *PasswordManager) HashIdempotent(ctx context.Context, key string, pwd string) (int64, bool, error) {
+	return pm.startHash(ctx, key, pwd, pm.nap)
+}
+
+// Start a hash per password, returns their task ids in the same order
+//   - all or none: a worker per password is reserved up front and the hashes start under one lock, so busy
+//     workers or a shutdown can't cut a batch short
+//   - returns ErrBatchTooLarge if there are fewer workers than passwords, ErrHashBusy if not enough of them
+//     are free and ErrShuttingDown once a shutdown began
+func (pm *PasswordManager) HashBatch(pwds []string) ([]int64, error) {
+	ts := pm.now()
+
+	if pm.workerPool != nil {
+		if len(pwds) > cap(pm.workerPool) {
+			return nil, ErrBatchTooLarge
+		}
+		for i := range pwds {
+			select {
+			case pm.workerPool <- struct{}{}: // released by calculateHash
+			default:
+				pm.releaseWorkers(i)
+				return nil, ErrHashBusy
+			}
+		}
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	if pm.IsShuttingDown() {
+		pm.releaseWorkers(len(pwds))
+		return nil, ErrShuttingDown
+	}
+
+	ids := make([]int64, len(pwds))
+	for i, pwd := range pwds {
+		ids[i] = pm.newTask()
+		go pm.calculateHash(context.Background(), ids[i], pwd, newSalt(), ts, pm.nap)
+	}
+	pm.reserveIDs()
+
+	return ids, nil
+}
+
+// Returns n reserved workers to the pool
+func (pm *PasswordManager) releaseWorkers(n int) {
+	for i := 0; pm.workerPool != nil && i < n; i++ {
+		<-pm.workerPool
+	}
+}
+
+// Start hash with a processing delay other than the configured one, returns task id
+func (pm *PasswordManager) HashWithDelay(pwd string, nap time.Duration) int64 {
+	id, _ := pm.hashWithContext(context.Background(), pwd, nap)
+	return id
+}
+
+var ErrHashBusy = errors.New("all workers are busy")
+var ErrShuttingDown = errors.New("shutdown is in progress")
+var ErrBatchTooLarge = errors.New("batch is larger than the worker pool")
+
+// Start hash
+//   - returns HashBusy if all workers are busy and HashShuttingDown once a shutdown began, along with the
+//     error; the shutdown is checked under the lock that Shutdown takes, so pendingHashes only decreases
+//     while draining
+func (pm *PasswordManager) hashWithContext(ctx context.Context, pwd string, nap time.Duration) (int64, error) {
+	id, _, err := pm.startHash(ctx, "", pwd, nap)
+	return id, err
+}
+
+// Start hash, or look up the one already started for key if it isn't empty
+//   - the lookup and the start happen under one lock, so concurrent requests with the same key can't
+//     both start a hash
+func (pm *PasswordManager) startHash(ctx context.Context, key string, pwd string, nap time.Duration) (int64, bool, error) {
+	ts := pm.now() // spec didn't say if time keeping should include the 5s nap time; here it's calculated for the
 	                 // whole request including nap
 
+	if pm.workerPool != nil {
+		select {
+		case pm.workerPool <- struct{}{}: // released by calculateHash
+		default:
+			return HashBusy, false, ErrHashBusy
+		}
+	}
+
 	pm.Lock()
-	pm.pendingHashes++
+	if pm.IsShuttingDown() {
+		pm.Unlock()
+		if pm.workerPool != nil {
+			<-pm.workerPool
+		}
+		return HashShuttingDown, false, ErrShuttingDown
+	}
+	if id, ok := pm.keys[key]; ok && key != "" {
+		pm.expireTask(id)
+		if state := pm.state(id); state == TaskPending || state == TaskReady {
+			pm.Unlock()
+			if pm.workerPool != nil {
+				<-pm.workerPool
+			}
+			return id, true, nil
+		}
+	}
 
-	id := pm.id // next available id
-	pm.id++     // update next id
+	id := pm.newTask()
+	if key != "" {
+		pm.keys[key] = id
+	}
+	pm.reserveIDs()
 
 	pm.Unlock()
 
 	// need to return id immediately... start the calculation async
-	go pm.calculateHash(id, pwd, ts)
+	go pm.calculateHash(ctx, id, pwd, newSalt(), ts, nap)
+
+	return id, false, nil
+}
+
+// Hands out the next id for a hash that is about to be calculated; needs the lock
+func (pm *PasswordManager) newTask() int64 {
+	atomic.AddInt64(&pm.pendingHashes, 1)
+	pm.metrics.hashStarted()
+	pm.wg.Add(1) // under the lock, so it can't race the Wait of a shutdown
+	id := pm.id // next available id
+	pm.id++     // update next id
+	pm.pending[id] = true
 
 	return id
 }
 
 // Calculate the hash
-func (pm* PasswordManager) calculateHash(id int64, pwd string, ts time.Time) {
+//   - runs in its own goroutine, so a panicking hasher would take down the process; it fails the task instead
+func (pm* PasswordManager) calculateHash(ctx context.Context, id int64, pwd string, salt []byte, ts time.Time, nap time.Duration) {
 
-	time.Sleep(NapTimeSec) // sim processing
+	defer pm.wg.Done()
+	if pm.workerPool != nil {
+		defer func() { <-pm.workerPool }()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("hash panicked", "hash_id", id, "panic", r)
+			pm.failHash(id)
+		}
+	}()
+
+	timer := time.NewTimer(nap) // sim processing
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		pm.cancelHash(id)
+		return
+	}
+
+	start := pm.now()
+	hashedPwd, err := pm.hasher(pm.Algorithm, pm.Params, pwd, salt)
+	pm.addCPUTime(pm.now().Sub(start))
+
+	if err != nil { // only happens with invalid parameters
+		slog.Error("hash failed", "hash_id", id, "error", err)
+		pm.failHash(id)
+		return
+	}
 
-	// Simple hash ... this won't protect against dictionary attacks; needs salt etc.
-	digest := sha512.New() // might want to cache
-	digest.Write([]byte(pwd))
-	hashedPwd := digest.Sum(nil)
+	pm.storeHash(id, hashedPwd, ts)
+}
 
-	// store the has and update the total hash time
+// Store the hash and update the total hash time
+func (pm *PasswordManager) storeHash(id int64, hashedPwd storedHash, ts time.Time) {
 	pm.Lock()
-	pm.tasks[id] = hashedPwd
+	if pm.deleted[id] { // deleted while it was calculated, nobody wants it; still counts in the stats
+		pm.addMarker(id)
+	} else {
+		pm.addTask(id, hashedPwd)
+	}
+	delete(pm.pending, id)
 
-	elapsed := time.Now().Sub(ts)
+	// ts carries a monotonic reading as long as it comes straight from time.Now(), so NTP adjustments
+	// don't affect it; still guard against clocks that go backward to keep totalTime sane
+	elapsed := pm.now().Sub(ts)
+	if elapsed < 0 {
+		elapsed = 0
+	}
 	pm.totalTime += elapsed
+	atomic.AddInt64(&pm.approxTotalTime, int64(elapsed))
+	pm.addDuration(elapsed)
+
+	pm.completions = append(pm.trimCompletions(), pm.now())
 
-	// done with this request, updated pendingHashes and increment the total number of processed requests
-	pm.pendingHashes--
+	// done with this request, increment the total number of processed requests and update pendingHashes
 	pm.requests++
+	atomic.AddInt64(&pm.approxRequests, 1)
 
 	pm.Unlock()
+
+	atomic.AddInt64(&pm.pendingHashes, -1) // after the hash is stored, so that no pending hashes means all are there
+	pm.metrics.hashDone(elapsed)
 }
 
-// Get the hash for task id; removes the task
-func (pm *PasswordManager) Get(id int64) []byte {
-	pm.Lock()
-	defer pm.Unlock()
+// Add a hash to tasks, evicting the least recently used one if tasks is full; needs the lock
+//   - an evicted hash looks like it was already retrieved
+func (pm *PasswordManager) addTask(id int64, hashedPwd storedHash) {
+	for pm.maxEntries > 0 && len(pm.tasks) >= pm.maxEntries && pm.lru.Len() > 0 {
+		oldest := pm.lru.Back().Value.(int64)
+		slog.Warn("evicting unretrieved hash", "hash_id", oldest)
+		pm.removeTask(oldest)
+		pm.evicted++
+	}
 
-	pwdHash := pm.tasks[id]
-	delete(pm.tasks, id) // Spec didn't say what to do with hashes after they are retrieved ... delete to avoid OOM
+	if pm.entryTTL > 0 && hashedPwd.expiresAt.IsZero() { // imported hashes keep their expiry
+		hashedPwd.expiresAt = pm.now().Add(pm.entryTTL)
+	}
+	pm.tasks[id] = hashedPwd
+	pm.lruElems[id] = pm.lru.PushFront(id)
+	if pm.store != nil {
+		pm.logStoreError(pm.store.Put(id, hashedPwd.bytes(), hashedPwd.expiresAt))
+	}
+}
 
-	return pwdHash
+// Reserves the next block of ids in the store once pm.id reaches the reserved ones, so that a restart
+// doesn't hand them out again; needs the lock
+//   - in blocks, so that not every hash writes to the store while holding the lock
+func (pm *PasswordManager) reserveIDs() {
+	if pm.store != nil && pm.id > pm.reservedID {
+		pm.reservedID = pm.id + StoreReserveBlock
+		pm.logStoreError(pm.store.Reserve(pm.reservedID))
+	}
 }
 
-// Returns the number of requests and avg processing time in ms
-func (pm *PasswordManager) Stats() (requests int64 , avgTime int64) {
+// Remove a hash from tasks; needs the lock
+func (pm *PasswordManager) removeTask(id int64) {
+	if _, ok := pm.tasks[id]; ok && pm.store != nil {
+		pm.logStoreError(pm.store.Delete(id))
+	}
+
+	delete(pm.tasks, id)
+	delete(pm.verifyFailures, id)
+	if elem := pm.lruElems[id]; elem != nil {
+		pm.lru.Remove(elem)
+		delete(pm.lruElems, id)
+	}
+}
+
+// Helper that logs failed writes to the store ... the hashes in memory stay correct, only a restart would
+// lose them
+func (pm *PasswordManager) logStoreError(err error) {
+	if err != nil {
+		slog.Error("store failed", "error", err)
+	}
+	pm.storeErr = err
+}
 
+// Returns the error of the latest store write, nil if it succeeded or there's no store
+func (pm *PasswordManager) StoreError() error {
 	pm.Lock()
 	defer pm.Unlock()
 
-	requests = pm.requests
-	if requests > 0 {
-		avgTime = (pm.totalTime.Nanoseconds() / 1000000) / requests
+	return pm.storeErr
+}
+
+// Remembers why there's no hash for id, see state; needs the lock
+//   - markers are bounded by maxEntries and expire with the entry TTL just like hashes; once dropped the
+//     hash looks like it was already retrieved
+//   - a hash deleted while it's calculated only gets its marker once the calculation ended, dropping it
+//     earlier would store the hash after all
+func (pm *PasswordManager) addMarker(id int64) {
+	pm.markers.PushBack(marker{id: id, at: pm.now()})
+	for pm.maxEntries > 0 && pm.markers.Len() > pm.maxEntries {
+		pm.dropMarker(pm.markers.Front())
 	}
+}
 
-	return
+// Forgets the marker in elem; needs the lock
+func (pm *PasswordManager) dropMarker(elem *list.Element) {
+	id := pm.markers.Remove(elem).(marker).id
+	delete(pm.failed, id)
+	delete(pm.cancelled, id)
+	delete(pm.deleted, id)
 }
 
-// Indicates if hashes are in progress
-func (pm *PasswordManager) HasPendingHashes() bool {
+// Mark a pending hash whose context was cancelled as cancelled
+func (pm *PasswordManager) cancelHash(id int64) {
 	pm.Lock()
 	defer pm.Unlock()
 
-	return pm.pendingHashes > 0
+	delete(pm.pending, id)
+	if !pm.deleted[id] {
+		pm.cancelled[id] = true
+	}
+	pm.addMarker(id)
+	atomic.AddInt64(&pm.pendingHashes, -1)
+	pm.metrics.hashCancelled()
 }
 
-// Initiate a shutdown
-func (pm *PasswordManager) Shutdown() {
+// Mark a pending hash that couldn't be calculated as failed
+func (pm *PasswordManager) failHash(id int64) {
 	pm.Lock()
 	defer pm.Unlock()
 
-	pm.shuttingDown = true
+	delete(pm.pending, id)
+	if !pm.deleted[id] {
+		pm.failed[id] = true
+	}
+	pm.addMarker(id)
+	atomic.AddInt64(&pm.pendingHashes, -1)
+	pm.metrics.hashFailed()
 }
 
-// Returns true if shutdown is in progress
-func (pm *PasswordManager) IsShuttingDown() bool {
+// Get the hash for task id; removes the task
+//   - returns the state the task was in, which tells why there's no hash if it's nil
+func (pm *PasswordManager) Get(id int64) ([]byte, TaskState) {
 	pm.Lock()
 	defer pm.Unlock()
 
-	return pm.shuttingDown
-}
+	pm.expireTask(id) // the cleanup may not have gotten to it yet
+	state := pm.state(id)
+	if state == TaskPending {
+		pm.polls[id]++
+	}
+	if state != TaskReady {
+		return nil, state
+	}
 
-//
-// Handler Adapter
-//   - Wraps REST endpoints and delegates actual work (business logic) to a PasswordManagerInterface
-//   - Implemented as a type to allow different PasswordManager implementations
-//
+	pwdHash := pm.tasks[id]
+	pm.removeTask(id) // Spec didn't say what to do with hashes after they are retrieved ... delete to avoid OOM
+	delete(pm.polls, id)
 
-type PasswordManagerHandler struct {
-	PasswordManager PasswordManagerInterface
+	return pwdHash.bytes(), state
 }
 
-func NewPasswordManagerHandler(pm PasswordManagerInterface) (*PasswordManagerHandler) {
-	pwh := new(PasswordManagerHandler)
-	pwh.PasswordManager = pm
-
-	return pwh
-}
+// Discard the hash for task id without retrieving it; returns false if there was none
+//   - a pending hash is still calculated, but discarded instead of stored
+func (pm *PasswordManager) Delete(id int64) bool {
+	pm.Lock()
+	defer pm.Unlock()
 
-// Helper that returns an HTTP error if shutdown is in progress
-func (pmh PasswordManagerHandler) isShutdownPending(w http.ResponseWriter) bool {
+	pm.expireTask(id)
+	state := pm.state(id)
+	if state != TaskReady && state != TaskPending {
+		return false
+	}
 
-	if pmh.PasswordManager.IsShuttingDown() {
-		http.Error(w, "Shutdown is pending - request rejected", http.StatusForbidden) // TODO: Better status
-		return true
+	pm.removeTask(id)
+	delete(pm.pending, id) // the calculation keeps pendingHashes until it's done, so a shutdown waits for it
+	delete(pm.polls, id)
+	pm.deleted[id] = true
+	if state == TaskReady {
+		pm.addMarker(id) // otherwise once the calculation ended
 	}
 
-	return false
+	return true
 }
 
-// POST /hash
-func (pmh PasswordManagerHandler) hash(w http.ResponseWriter, req *http.Request) {
+var ErrTooManyFailures = errors.New("too many failed verifications")
 
-	if pmh.isShutdownPending(w) {
-		return
+// Checks a password against the hash of task id, in constant time, without removing it
+//   - false if there is no hash for id
+//   - after MaxVerifyFailures mismatches it returns ErrTooManyFailures instead of checking, so the ids
+//     can't be used to guess passwords. An attempt counts as a failure until it matched, so concurrent
+//     guesses can't exceed the limit either
+func (pm *PasswordManager) Verify(id int64, candidate string) (bool, error) {
+	pm.Lock()
+	pm.expireTask(id)
+	pwdHash, ok := pm.tasks[id]
+	if ok && pm.verifyFailures[id] >= MaxVerifyFailures {
+		pm.Unlock()
+		return false, ErrTooManyFailures
 	}
-
-	// sanity checks
-	if req.Method != http.MethodPost {
-		http.Error(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
-		return
+	if ok {
+		pm.verifyFailures[id]++
 	}
+	pm.Unlock()
 
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil || len(body) == 0 {
-		http.Error(w, "Can't read body", http.StatusBadRequest)
-		return
+	if !ok {
+		return false, nil
 	}
 
-	data := string(body[:])
-	items := strings.Split(data, "=")
-	if len(items) != 2 || items[0] != "password" || len(items[1]) == 0 {
-		http.Error(w, "Invalid parameters", http.StatusBadRequest)
-		return
+	match := VerifyPassword(candidate, pwdHash.bytes()) // outside the lock, the slow algorithms take a while
+	if match {
+		pm.Lock()
+		if _, ok := pm.tasks[id]; ok { // not retrieved meanwhile
+			pm.verifyFailures[id]--
+		}
+		pm.Unlock()
 	}
 
-	// delegate actual work
-	id := pmh.PasswordManager.Hash(items[1])
+	return match, nil
+}
 
-	w.WriteHeader(http.StatusAccepted) // resource not yet created
-	w.Write([]byte(strconv.FormatInt(int64(id), 10))) // TODO: Better approach to convert int to []byte?
+// Checks a password against a hash supplied by the client, e.g. for POST /verify
+//   - takes a worker slot while comparing, like a hash does; returns ErrHashBusy once they're all busy
+func (pm *PasswordManager) VerifyHash(candidate string, pwdHash []byte) (bool, error) {
+
+	if pm.workerPool != nil {
+		select {
+		case pm.workerPool <- struct{}{}:
+			defer func() { <-pm.workerPool }()
+		default:
+			return false, ErrHashBusy
+		}
+	}
 
-	// TODO securely destroy password
+	return VerifyPassword(candidate, pwdHash), nil
 }
 
-// GET /hash/<id>
-func (pmh PasswordManagerHandler) get(w http.ResponseWriter, req *http.Request) {
+// Get the hash for task id without removing it
+//   - also returns if the task exists, i.e. is pending or ready, to tell a hash that isn't ready from one
+//     that will never be
+func (pm *PasswordManager) Peek(id int64) ([]byte, bool) {
+	pm.Lock()
+	defer pm.Unlock()
 
-	// Spec didn't say if /get should be prevented as well
-	if pmh.isShutdownPending(w) {
-		return
+	if pm.pending[id] {
+		pm.polls[id]++
+		return nil, true
 	}
 
-	// sanity checks
-	if req.Method != http.MethodGet {
-		http.Error(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
-		return
+	pm.expireTask(id)
+	pwdHash, ok := pm.tasks[id]
+	if !ok {
+		return nil, false
 	}
-
-	ids := req.URL.Path[6:] // strip /hash/ from /hash/1245
-	id, err := strconv.ParseInt(ids, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid method resource id", http.StatusBadRequest)
-		return
+	if elem := pm.lruElems[id]; elem != nil {
+		pm.lru.MoveToFront(elem)
 	}
 
-	pwdHash := pmh.PasswordManager.Get(id)
+	return pwdHash.bytes(), true
+}
 
-	if pwdHash == nil {
-		http.Error(w, "Hash not found", http.StatusNotFound)
-		return
-	}
+// Returns how often Get or Peek was called for task id while the hash was still pending
+//   - Only kept until the hash is retrieved, so call it before the final Get
+func (pm *PasswordManager) PendingPolls(id int64) int {
+	pm.Lock()
+	defer pm.Unlock()
 
-	encoder := base64.NewEncoder(base64.StdEncoding, w)
-	encoder.Write(pwdHash)
-	encoder.Close()
+	return pm.polls[id]
 }
 
+// Returns the state of task id
+func (pm *PasswordManager) State(id int64) TaskState {
+	pm.Lock()
+	defer pm.Unlock()
 
-// GET /stats
-func (pmh PasswordManagerHandler) stats(w http.ResponseWriter, req *http.Request) {
+	pm.expireTask(id)
+	return pm.state(id)
+}
 
-	// Spec didn't say if /stats should be prevented as well
-	if pmh.isShutdownPending(w) {
-		return
-	}
+// Returns the time by which hash id must be retrieved before it expires; zero if it never expires or isn't there
+//   - a pending hash only starts its entry TTL once it's done, so the time returned for it is a lower bound
+func (pm *PasswordManager) ExpiresAt(id int64) time.Time {
+	pm.Lock()
+	defer pm.Unlock()
 
-	// sanity checks
-	if req.Method != http.MethodGet {
-		http.Error(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
-		return
+	pm.expireTask(id)
+	if pwdHash, ok := pm.tasks[id]; ok {
+		return pwdHash.expiresAt
+	}
+	if pm.pending[id] && pm.entryTTL > 0 {
+		return pm.now().Add(pm.entryTTL)
 	}
 
-	requests, avgTime := pmh.PasswordManager.Stats()
+	return time.Time{}
+}
 
-	// JSON is very simple ... therefore just create a string
-	body := fmt.Sprintf("{\"total\": %d, \"average\": %d}", requests, avgTime)
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Write([]byte(body))
+// Returns the state of task id; needs the lock
+func (pm *PasswordManager) state(id int64) TaskState {
+	if id < 0 || id >= pm.id {
+		return TaskUnknown
+	}
+	if _, ok := pm.tasks[id]; ok {
+		return TaskReady
+	}
+	if pm.pending[id] {
+		return TaskPending
+	}
+	if pm.failed[id] {
+		return TaskFailed
+	}
+	if pm.cancelled[id] {
+		return TaskCancelled
+	}
+	if pm.deleted[id] {
+		return TaskDeleted
+	}
+
+	return TaskGone // ids are handed out sequentially, so anything else was already retrieved
 }
 
-// Initiate a graceful shutdown
-func (pmh PasswordManagerHandler) shutdown() {
+// Returns the number of requests and avg processing time in ms
+func (pm *PasswordManager) Stats() (requests int64 , avgTime int64) {
 
-	fmt.Println("Shutting down")
-	pmh.PasswordManager.Shutdown()
+	pm.Lock()
+	defer pm.Unlock()
 
-	// TODO: Only wait for x seconds for graceful shutdown
-	for pmh.PasswordManager.HasPendingHashes() {
-		fmt.Println("Shutting down")
-		time.Sleep(1*time.Second)
+	requests = pm.requests
+	if requests > 0 {
+		avgTime = (pm.totalTime.Nanoseconds() / 1000000) / requests
 	}
 
-	fmt.Println("Done")
+	return
 }
 
+// Same as Stats but without taking the lock, for callers that prefer a fast answer under contention
+//   - The two values are read separately, so the average can be slightly off while hashes complete
+func (pm *PasswordManager) ApproxStats() (requests int64, avgTime int64) {
 
+	requests = atomic.LoadInt64(&pm.approxRequests)
+	if requests > 0 {
+		avgTime = (atomic.LoadInt64(&pm.approxTotalTime) / 1000000) / requests
+	}
 
-func main() {
-	port := flag.Int("port", 8000, "port number")
-	flag.Parse()
-
-	// DI
-	var pm PasswordManagerInterface = NewPasswordManager()
-	pmh := NewPasswordManagerHandler(pm)
+	return
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/hash", http.HandlerFunc(pmh.hash))
-	mux.Handle("/hash/", http.HandlerFunc(pmh.get))
-	mux.Handle("/stats", http.HandlerFunc(pmh.stats))
+// Resets the request count and average processing time
+//   - A hash is counted in the window in which it completes, so hashes that are in flight during a
+//     reset are counted after it, with their full processing time
+func (pm *PasswordManager) ResetStats() {
+	pm.Lock()
+	defer pm.Unlock()
 
-	// Shutdown handler
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		pmh.shutdown()
-		os.Exit(0)
-	}()
+	pm.resets++
+	pm.requests = 0
+	pm.totalTime = 0
+	atomic.StoreInt64(&pm.approxRequests, 0)
+	atomic.StoreInt64(&pm.approxTotalTime, 0)
+	pm.completions = nil
+	pm.durations = nil
+	pm.nextDuration = 0
+	pm.minTime, pm.maxTime = 0, 0
+	pm.evicted = 0
+}
 
-	log.Fatal(http.ListenAndServe("localhost:"+strconv.Itoa(*port), mux))
-}
\ No newline at end of file
+// Records the duration of a hash for StatsDetailed; needs the lock
+func (pm *PasswordManager) addDuration(d time.Duration) {
+	if pm.requests == 0 || d < pm.minTime { // requests is incremented after this
+		pm.minTime = d
+	}
+	if d > pm.maxTime {
+		pm.maxTime = d
+	}
+
+	if len(pm.durations) < MaxDurationSamples {
+		pm.durations = append(pm.durations, d)
+		return
+	}
+	pm.durations[pm.nextDuration] = d
+	pm.nextDuration = (pm.nextDuration + 1) % MaxDurationSamples
+}
+
+// Stats with the latency distribution
+//   - durations are in ms like the average of Stats; the percentiles cover the latest MaxDurationSamples
+//     hashes, min and max all since the last reset
+type DetailedStats struct {
+	Total int64
+	Average int64
+	Pending int
+	Min, Max int64
+	P50, P95 int64
+	Resets int64 // changes whenever Total restarts from 0
+	Evicted int64 // unretrieved hashes evicted because the manager was full, e.g. by clients not fetching results
+}
+
+// Returns the stats with the latency distribution
+func (pm *PasswordManager) StatsDetailed() DetailedStats {
+	requests, avgTime := pm.Stats()
+
+	pm.Lock()
+	sorted := append([]time.Duration(nil), pm.durations...)
+	minTime, maxTime, resets, evicted := pm.minTime, pm.maxTime, pm.resets, pm.evicted
+	pm.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return DetailedStats{Total: requests, Average: avgTime, Pending: pm.PendingCount(),
+		Min: minTime.Milliseconds(), Max: maxTime.Milliseconds(),
+		P50: percentile(sorted, 50).Milliseconds(), P95: percentile(sorted, 95).Milliseconds(), Resets: resets,
+		Evicted: evicted}
+}
+
+// Returns the quantiles, 0 to 1, of the latest hash durations, interpolated linearly between the samples;
+// 0 if there are none yet
+func (pm *PasswordManager) Quantiles(qs []float64) []time.Duration {
+	pm.Lock()
+	sorted := append([]time.Duration(nil), pm.durations...)
+	pm.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	values := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		values[i] = quantile(sorted, q)
+	}
+
+	return values
+}
+
+// Returns the q-quantile of sorted durations, interpolated between the two closest ranks; 0 if there are none
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+
+	return sorted[lower] + time.Duration(float64(sorted[upper]-sorted[lower])*(pos-float64(lower)))
+}
+
+// Returns the p-th percentile of sorted durations by the nearest rank method; 0 if there are none
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Accounts time spent hashing against the budget
+func (pm *PasswordManager) addCPUTime(d time.Duration) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	if d > 0 {
+		pm.cpuTime += d
+	}
+}
+
+// Returns true if the hashing budget is used up; new hashes should be rejected until ResetBudget
+//   - Protects shared hosts ... hashes already in progress still complete, so the budget can be
+//     overshot by a little
+func (pm *PasswordManager) BudgetExceeded() bool {
+	pm.Lock()
+	defer pm.Unlock()
+
+	return pm.CPUBudget > 0 && pm.cpuTime >= pm.CPUBudget
+}
+
+// Starts a new hashing budget
+func (pm *PasswordManager) ResetBudget() {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pm.cpuTime = 0
+}
+
+// Returns the number of hashes completed per second over the throughput window
+//   - Underestimates while the service has been up for less than the window
+func (pm *PasswordManager) Throughput() float64 {
+	pm.Lock()
+	defer pm.Unlock()
+
+	pm.completions = pm.trimCompletions()
+
+	return float64(len(pm.completions)) / pm.ThroughputWindow.Seconds()
+}
+
+// Drops completions that fell out of the throughput window; needs the lock
+func (pm *PasswordManager) trimCompletions() []time.Time {
+	cutoff := pm.now().Add(-pm.ThroughputWindow)
+
+	i := 0
+	for i < len(pm.completions) && !pm.completions[i].After(cutoff) {
+		i++
+	}
+
+	return pm.completions[i:]
+}
+
+// Returns the number of completed hashes that haven't been retrieved yet
+func (pm *PasswordManager) UnretrievedCount() int {
+	pm.Lock()
+	defer pm.Unlock()
+
+	return len(pm.tasks)
+}
+
+// Returns the number of hashes in progress
+func (pm *PasswordManager) PendingCount() int {
+	return int(atomic.LoadInt64(&pm.pendingHashes))
+}
+
+// Indicates if hashes are in progress
+func (pm *PasswordManager) HasPendingHashes() bool {
+	return atomic.LoadInt64(&pm.pendingHashes) > 0
+}
+
+// Indicates if all workers are busy, i.e. Hash would return HashBusy; never with unlimited workers
+func (pm *PasswordManager) IsSaturated() bool {
+	return pm.workerPool != nil && len(pm.workerPool) >= cap(pm.workerPool)
+}
+
+// Completed hashes of a manager, for moving them to another instance
+type TaskExport struct {
+	NextID int64 `json:"next_id"`         // ids below were handed out already
+	Hashes map[int64][]byte `json:"hashes"` // unretrieved hashes as Get returns them; base64 in JSON
+	Expires map[int64]time.Time `json:"expires,omitempty"` // when hashes expire; missing ones get a fresh TTL
+}
+
+// Returns the unretrieved hashes without removing them
+//   - pending hashes aren't included; export again once they're done
+func (pm *PasswordManager) Export() TaskExport {
+	pm.Lock()
+	defer pm.Unlock()
+
+	export := TaskExport{NextID: pm.id, Hashes: make(map[int64][]byte, len(pm.tasks)), Expires: make(map[int64]time.Time)}
+	for id, pwdHash := range pm.tasks {
+		export.Hashes[id] = pwdHash.bytes()
+		if !pwdHash.expiresAt.IsZero() {
+			export.Expires[id] = pwdHash.expiresAt
+		}
+	}
+
+	return export
+}
+
+// Adds exported hashes; fails without changes if an id was already handed out here
+//   - ids handed out from now on start after the exported ones
+func (pm *PasswordManager) Import(export TaskExport) error {
+	pm.Lock()
+	defer pm.Unlock()
+
+	for id, pwdHash := range export.Hashes {
+		if id < 0 || id >= export.NextID || len(pwdHash) == 0 {
+			return fmt.Errorf("invalid hash %d", id)
+		}
+		if id < pm.id { // handed out here already, even if it's gone or forgotten by now
+			return fmt.Errorf("hash %d already exists", id)
+		}
+	}
+
+	for id, pwdHash := range export.Hashes {
+		sh := parseStoredHash(pwdHash)
+		sh.expiresAt = export.Expires[id]
+		if !sh.expiresAt.IsZero() && !pm.now().Before(sh.expiresAt) { // expired while it was exported
+			continue
+		}
+		pm.addTask(id, sh)
+	}
+	if export.NextID > pm.id {
+		pm.id = export.NextID
+		pm.reserveIDs()
+	}
+
+	return nil
+}
+
+// Loads the hashes of store and persists all changes to it from now on
+//   - compacts the store to the hashes that are still there, the log would only grow otherwise
+func (pm *PasswordManager) Restore(store Store) error {
+	export, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if err := pm.Import(export); err != nil {
+		return err
+	}
+
+	export = pm.Export()
+	if err := store.Compact(export); err != nil {
+		return err
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	pm.store = store
+	pm.reservedID = export.NextID
+
+	return nil
+}
+
+// Waits for all pending hashes to complete, then removes and returns all hashes
+//   - If ctx is done first, only the hashes completed so far are returned
+func (pm *PasswordManager) DrainAll(ctx context.Context) map[int64][]byte {
+
+	ticker := time.NewTicker(10*time.Millisecond)
+	defer ticker.Stop()
+
+	for waiting := true; waiting && pm.HasPendingHashes(); {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
+
+	pm.Lock()
+	defer pm.Unlock()
+
+	results := make(map[int64][]byte, len(pm.tasks))
+	for id, pwdHash := range pm.tasks {
+		results[id] = pwdHash.bytes()
+		pm.removeTask(id)
+	}
+	pm.polls = make(map[int64]int)
+
+	return results
+}
+
+// Initiate a shutdown
+func (pm *PasswordManager) Shutdown() {
+	pm.Lock()
+	defer pm.Unlock()
+
+	atomic.StoreInt32(&pm.shuttingDown, 1)
+	pm.shutdownOnce.Do(func() {
+		close(pm.quit)
+		go func() { // Hash doesn't add to wg anymore
+			pm.wg.Wait()
+			close(pm.drained)
+		}()
+	})
+}
+
+// Returns a channel that is closed once a shutdown is in progress and all pending hashes are done
+func (pm *PasswordManager) Drained() <-chan struct{} {
+	return pm.drained
+}
+
+// Returns true if shutdown is in progress
+func (pm *PasswordManager) IsShuttingDown() bool {
+	return atomic.LoadInt32(&pm.shuttingDown) == 1
+}
+
+// Turn maintenance mode on or off; unlike a shutdown this is reversible and doesn't drain anything
+func (pm *PasswordManager) SetMaintenance(on bool) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&pm.maintenance, value)
+}
+
+// Returns true if maintenance mode is on
+func (pm *PasswordManager) IsInMaintenance() bool {
+	return atomic.LoadInt32(&pm.maintenance) == 1
+}
+
+//
+// Persistence
+//   - A Store keeps what a restart would lose: completed hashes and the next id. Pending hashes are lost,
+//     their ids are never handed out again
+//
+
+type Store interface {
+	Put(id int64, pwdHash []byte, expiresAt time.Time) error // hash as Get returns it; zero expiresAt never expires
+	Delete(id int64) error
+	Reserve(nextID int64) error         // ids below nextID were handed out
+	Load() (TaskExport, error)
+	Compact(export TaskExport) error    // replaces the contents with export
+}
+
+// Store that appends each change to a file as a JSON line; Load replays them
+//   - the file grows until the next Compact; writes aren't synced, so they survive a crash of the process
+//     but not of the machine
+type FileStore struct {
+	sync.Mutex
+	path string
+	file *os.File
+	enc *json.Encoder
+}
+
+// Change of a FileStore
+type storeRecord struct {
+	Op string `json:"op"` // put, delete or reserve
+	ID int64 `json:"id"`
+	Hash []byte `json:"hash,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"` // of a put; nil never
+}
+
+// Constructor; creates the file if it doesn't exist
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := openStoreFile(path, os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func openStoreFile(path string, flags int) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND|flags, 0600) // hashes are sensitive
+}
+
+func (fs *FileStore) Put(id int64, pwdHash []byte, expiresAt time.Time) error {
+	return fs.write(putRecord(id, pwdHash, expiresAt))
+}
+
+func putRecord(id int64, pwdHash []byte, expiresAt time.Time) storeRecord {
+	record := storeRecord{Op: "put", ID: id, Hash: pwdHash}
+	if !expiresAt.IsZero() {
+		record.Expires = &expiresAt
+	}
+
+	return record
+}
+
+func (fs *FileStore) Delete(id int64) error {
+	return fs.write(storeRecord{Op: "delete", ID: id})
+}
+
+func (fs *FileStore) Reserve(nextID int64) error {
+	return fs.write(storeRecord{Op: "reserve", ID: nextID})
+}
+
+func (fs *FileStore) write(record storeRecord) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	return fs.enc.Encode(record)
+}
+
+// Replays the file
+//   - a truncated last record, e.g. from a crash during a write, is cut off; otherwise the next write would
+//     append to it and the file couldn't be replayed anymore
+func (fs *FileStore) Load() (TaskExport, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	export := TaskExport{Hashes: make(map[int64][]byte), Expires: make(map[int64]time.Time)}
+	if _, err := fs.file.Seek(0, io.SeekStart); err != nil {
+		return export, err
+	}
+
+	dec := json.NewDecoder(fs.file)
+	for {
+		complete := dec.InputOffset() // end of the last complete record
+		var record storeRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if err := fs.file.Truncate(complete); err != nil {
+				return export, err
+			}
+			break
+		}
+		if err != nil {
+			return export, err
+		}
+
+		switch record.Op {
+		case "put":
+			export.Hashes[record.ID] = record.Hash
+			if record.Expires != nil {
+				export.Expires[record.ID] = *record.Expires
+			}
+			if record.ID >= export.NextID {
+				export.NextID = record.ID+1
+			}
+		case "delete":
+			delete(export.Hashes, record.ID)
+			delete(export.Expires, record.ID)
+		case "reserve":
+			if record.ID > export.NextID {
+				export.NextID = record.ID
+			}
+		default:
+			return export, fmt.Errorf("unknown store operation '%s'", record.Op)
+		}
+	}
+
+	return export, nil
+}
+
+// Rewrites the file with just the hashes and next id of export
+//   - writes a new file and renames it over the old one, so a crash leaves either of them complete
+func (fs *FileStore) Compact(export TaskExport) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tmpPath := fs.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for id, pwdHash := range export.Hashes {
+		if err = enc.Encode(putRecord(id, pwdHash, export.Expires[id])); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = enc.Encode(storeRecord{Op: "reserve", ID: export.NextID})
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fs.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	file, err := openStoreFile(fs.path, 0)
+	if err != nil {
+		return err
+	}
+	fs.file.Close()
+	fs.file, fs.enc = file, json.NewEncoder(file)
+
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	return fs.file.Close()
+}
+
+//
+// Hash algorithms
+//   - Hashes returned by Get start with a version byte naming the algorithm, followed by the
+//     algorithm's output: bcrypt's own $2a$<cost>$ format, PHC strings for scrypt and argon2id, which
+//     record the cost and salt, and salt || digest for sha512
+//   - Every password gets a random salt, so identical passwords get different hashes
+//   - sha512 is fast; it's there for compatibility with legacy systems, prefer one of the others for
+//     new deployments
+//
+
+type Algorithm string
+
+const (
+	SHA512 Algorithm = "sha512"
+	Bcrypt Algorithm = "bcrypt"
+	Scrypt Algorithm = "scrypt"
+	Argon2id Algorithm = "argon2id"
+)
+
+var Algorithms = []Algorithm{SHA512, Bcrypt, Scrypt, Argon2id}
+
+// Version bytes in front of every hash
+const (
+	VersionSHA512 byte = 0x01
+	VersionBcrypt byte = 0x02
+	VersionArgon2id byte = 0x03
+	VersionScrypt byte = 0x04
+)
+
+var algorithmVersions = map[Algorithm]byte{SHA512: VersionSHA512, Bcrypt: VersionBcrypt, Argon2id: VersionArgon2id, Scrypt: VersionScrypt}
+
+// Cost parameters; each algorithm only uses its own
+type HashParams struct {
+	BcryptCost int
+	ScryptN, ScryptR, ScryptP int
+	Argon2Time, Argon2Memory uint32 // memory in KiB
+	Argon2Threads uint8
+}
+
+var DefaultHashParams = HashParams{
+	BcryptCost: bcrypt.DefaultCost,
+	ScryptN: 1<<15, ScryptR: 8, ScryptP: 1,            // recommended interactive login parameters
+	Argon2Time: 1, Argon2Memory: 64*1024, Argon2Threads: 4,
+}
+
+const (
+	SaltLen = 16        // random salt per password; bcrypt makes its own
+	KeyLen = 32         // derived key length for scrypt and argon2id
+	BcryptMaxLen = 72   // bcrypt only looks at the first 72 bytes of a password
+)
+
+// Hashes a salted password with the given algorithm
+//   - bcrypt silently truncates passwords to 72 bytes, so two passwords sharing the first 72 bytes
+//     get the same hash. It also ignores the salt; the bcrypt package only uses salts it generates
+func hashPassword(algo Algorithm, params HashParams, pwd string, salt []byte) (storedHash, error) {
+
+	version, ok := algorithmVersions[algo]
+	if !ok {
+		return storedHash{}, fmt.Errorf("unknown algorithm '%s'", algo)
+	}
+
+	pwdHash, err := hashWith(algo, params, pwd, salt)
+	if err != nil {
+		return storedHash{}, err
+	}
+
+	sh := storedHash{hash: append([]byte{version}, pwdHash...)}
+	if algo == SHA512 { // the other encodings already contain the salt
+		sh.salt = salt
+	}
+
+	return sh, nil
+}
+
+// Hashes a password with the given algorithm, without version byte
+func hashWith(algo Algorithm, params HashParams, pwd string, salt []byte) ([]byte, error) {
+
+	switch algo {
+	case SHA512:
+		digest := saltedSHA512(salt, pwd)
+		return digest[:], nil
+
+	case Bcrypt:
+		return bcrypt.GenerateFromPassword(truncate(pwd, BcryptMaxLen), params.BcryptCost)
+
+	case Scrypt:
+		key, err := scrypt.Key([]byte(pwd), salt, params.ScryptN, params.ScryptR, params.ScryptP, KeyLen)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", log2(params.ScryptN), params.ScryptR, params.ScryptP,
+			b64(salt), b64(key))), nil
+
+	case Argon2id:
+		key := argon2.IDKey([]byte(pwd), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, KeyLen)
+		return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Argon2Memory,
+			params.Argon2Time, params.Argon2Threads, b64(salt), b64(key))), nil
+	}
+
+	return nil, fmt.Errorf("unknown algorithm '%s'", algo)
+}
+
+// Upper bounds for the cost recorded in a hash passed to VerifyPassword
+//   - the cost comes from the hash itself, so without them a caller of /verify picks how much CPU and memory
+//     a check takes
+var MaxHashParams = HashParams{
+	BcryptCost: 12,
+	ScryptN: 1<<16, ScryptR: 8, ScryptP: 2,
+	Argon2Time: 3, Argon2Memory: 128*1024, Argon2Threads: 8,
+}
+
+var ErrHashCost = errors.New("hash cost exceeds the maximum")
+
+// Checks the cost recorded in a hash returned by Get against MaxHashParams
+//   - malformed hashes pass; VerifyPassword rejects them anyway
+func CheckHashCost(pwdHash []byte) error {
+
+	if len(pwdHash) == 0 {
+		return nil
+	}
+
+	exceeded := false
+	switch pwdHash[0] {
+	case VersionBcrypt:
+		cost, err := bcrypt.Cost(pwdHash[1:])
+		exceeded = err == nil && cost > MaxHashParams.BcryptCost
+
+	case VersionScrypt:
+		if ln, r, p, _, _, err := parseScrypt(string(pwdHash[1:])); err == nil {
+			exceeded = ln < 0 || ln > log2(MaxHashParams.ScryptN) || r > MaxHashParams.ScryptR || p > MaxHashParams.ScryptP
+		}
+
+	case VersionArgon2id:
+		if m, t, p, _, _, err := parseArgon2id(string(pwdHash[1:])); err == nil {
+			exceeded = m > MaxHashParams.Argon2Memory || t > MaxHashParams.Argon2Time || p > MaxHashParams.Argon2Threads
+		}
+	}
+
+	if exceeded {
+		return ErrHashCost
+	}
+
+	return nil
+}
+
+// Checks a password against a hash returned by Get, in constant time
+//   - false for hashes whose cost exceeds MaxHashParams
+func VerifyPassword(pwd string, pwdHash []byte) bool {
+
+	if len(pwdHash) == 0 || CheckHashCost(pwdHash) != nil {
+		return false
+	}
+
+	version, encoded := pwdHash[0], string(pwdHash[1:])
+	switch version {
+	case VersionBcrypt:
+		return bcrypt.CompareHashAndPassword(pwdHash[1:], truncate(pwd, BcryptMaxLen)) == nil
+
+	case VersionScrypt:
+		ln, r, p, salt, key, err := parseScrypt(encoded)
+		if err != nil {
+			return false
+		}
+		return deriveAndCompare(salt, key, func(salt []byte, keyLen int) []byte {
+			candidate, _ := scrypt.Key([]byte(pwd), salt, 1<<uint(ln), r, p, keyLen)
+			return candidate
+		})
+
+	case VersionArgon2id:
+		m, t, p, salt, key, err := parseArgon2id(encoded)
+		if err != nil || t < 1 || p < 1 { // argon2 panics on them
+			return false
+		}
+		return deriveAndCompare(salt, key, func(salt []byte, keyLen int) []byte {
+			return argon2.IDKey([]byte(pwd), salt, t, m, p, uint32(keyLen))
+		})
+
+	case VersionSHA512:
+		salt, hash, err := SplitSaltAndHash(pwdHash)
+		if err != nil {
+			return false
+		}
+		digest := saltedSHA512(salt, pwd)
+		return subtle.ConstantTimeCompare(digest[:], hash) == 1
+	}
+
+	return false
+}
+
+// Parses a $scrypt$ln=<ln>,r=<r>,p=<p>$<salt>$<key> PHC string
+func parseScrypt(encoded string) (ln, r, p int, salt, key string, err error) {
+	_, err = fmt.Sscanf(strings.Replace(encoded, "$", " ", -1), " scrypt ln=%d,r=%d,p=%d %s %s", &ln, &r, &p, &salt, &key)
+	return
+}
+
+// Parses a $argon2id$v=<v>$m=<m>,t=<t>,p=<p>$<salt>$<key> PHC string
+func parseArgon2id(encoded string) (m, t uint32, p uint8, salt, key string, err error) {
+	var v int
+	_, err = fmt.Sscanf(strings.Replace(encoded, "$", " ", -1), " argon2id v=%d m=%d,t=%d,p=%d %s %s", &v, &m, &t, &p, &salt, &key)
+	return
+}
+
+// Splits a sha512 hash returned by Get into its salt and digest
+//   - takes the whole value including the version byte; the 80 bytes after it are salt || digest
+func SplitSaltAndHash(blob []byte) (salt, hash []byte, err error) {
+	if len(blob) == 0 || blob[0] != VersionSHA512 {
+		return nil, nil, errors.New("not a sha512 hash")
+	}
+	if len(blob) != 1+SaltLen+sha512.Size {
+		return nil, nil, fmt.Errorf("sha512 hash is %d bytes, expected %d", len(blob), 1+SaltLen+sha512.Size)
+	}
+
+	return blob[1:1+SaltLen], blob[1+SaltLen:], nil
+}
+
+// Helper that decodes salt and key of a PHC string and compares the key with the one derived from the salt
+func deriveAndCompare(encodedSalt string, encodedKey string, derive func(salt []byte, keyLen int) []byte) bool {
+	salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	candidate := derive(salt, len(key))
+
+	return candidate != nil && subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+func saltedSHA512(salt []byte, pwd string) [sha512.Size]byte {
+	return sha512.Sum512(append(append([]byte{}, salt...), pwd...))
+}
+
+func newSalt() []byte {
+	salt := make([]byte, SaltLen)
+	rand.Read(salt) // never fails, see crypto/rand docs
+
+	return salt
+}
+
+func truncate(pwd string, n int) []byte {
+	if len(pwd) > n {
+		return []byte(pwd[:n])
+	}
+
+	return []byte(pwd)
+}
+
+// Base64 without padding, as PHC strings use it
+func b64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func log2(n int) int {
+	ln := 0
+	for n > 1 {
+		n >>= 1
+		ln++
+	}
+
+	return ln
+}
+
+//
+// Prometheus metrics
+//   - Registered with an injected registry, so that tests can use their own; the methods are no-ops on a
+//     nil *Metrics, so managers and handlers work without
+//
+type Metrics struct {
+	registry *prometheus.Registry
+	requests prometheus.Counter  // POST /hash requests
+	duration prometheus.Histogram // time from the request to the stored hash, including the nap
+	pending prometheus.Gauge     // hashes being calculated
+	errors prometheus.Counter    // hashes that couldn't be calculated
+}
+
+// Constructor; registers the metrics with reg
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		registry: reg,
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "passwordservice_hash_requests_total",
+			Help: "Number of POST /hash requests.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "passwordservice_hash_duration_seconds",
+			Help:    "Time from the hash request until the hash is stored.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "passwordservice_pending_hashes",
+			Help: "Number of hashes being calculated.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "passwordservice_hash_errors_total",
+			Help: "Number of hashes that couldn't be calculated.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.duration, m.pending, m.errors)
+
+	return m
+}
+
+// Returns the handler for /metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) hashRequested() {
+	if m != nil {
+		m.requests.Inc()
+	}
+}
+
+func (m *Metrics) hashStarted() {
+	if m != nil {
+		m.pending.Inc()
+	}
+}
+
+func (m *Metrics) hashDone(elapsed time.Duration) {
+	if m != nil {
+		m.pending.Dec()
+		m.duration.Observe(elapsed.Seconds())
+	}
+}
+
+func (m *Metrics) hashCancelled() {
+	if m != nil {
+		m.pending.Dec()
+	}
+}
+
+func (m *Metrics) hashFailed() {
+	if m != nil {
+		m.pending.Dec()
+		m.errors.Inc()
+	}
+}
+
+//
+// Poll limiter
+//   - Remembers when a client last polled a task id and tells it to back off if it polls faster than
+//     the configured interval
+//
+type PollLimiter struct {
+	sync.Mutex
+	interval time.Duration         // minimum time between two polls of the same id by the same client
+	lastPoll map[pollKey]time.Time // last poll time per client, tenant and id
+	lastSweep time.Time            // last time stale entries were removed
+	now func() time.Time           // clock; replaceable for tests
+}
+
+type pollKey struct {
+	client string
+	tenant string // ids are only unique per tenant
+	id int64
+}
+
+// Constructor
+func NewPollLimiter(interval time.Duration) *PollLimiter {
+	return &PollLimiter{interval: interval, lastPoll: make(map[pollKey]time.Time), now: time.Now}
+}
+
+// Records a poll; returns 0 if it's allowed, otherwise how long the client should wait
+func (pl *PollLimiter) Allow(client string, tenant string, id int64) time.Duration {
+	pl.Lock()
+	defer pl.Unlock()
+
+	now := pl.now()
+
+	// entries older than the interval can't reject anything anymore ... sweep them once per interval
+	// so the map doesn't grow with every id ever polled
+	if now.Sub(pl.lastSweep) > pl.interval {
+		for key, ts := range pl.lastPoll {
+			if now.Sub(ts) >= pl.interval {
+				delete(pl.lastPoll, key)
+			}
+		}
+		pl.lastSweep = now
+	}
+
+	key := pollKey{client, tenant, id}
+	if last, ok := pl.lastPoll[key]; ok {
+		if wait := pl.interval - now.Sub(last); wait > 0 {
+			return wait // a rejected poll doesn't restart the interval
+		}
+	}
+
+	pl.lastPoll[key] = now
+
+	return 0
+}
+
+//
+// Rate limiter
+//   - Token bucket per client: a client can send burst requests at once, then rate requests per second
+//
+type RateLimiter struct {
+	sync.Mutex
+	rate float64                    // tokens added per second
+	burst float64                   // bucket size
+	buckets map[string]*tokenBucket // bucket per client
+	lastSweep time.Time             // last time full buckets were removed
+	now func() time.Time            // clock; replaceable for tests
+}
+
+type tokenBucket struct {
+	tokens float64
+	last time.Time // last time tokens were added
+}
+
+// Constructor
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// Takes a token of the client; returns 0 if there was one, otherwise how long the client should wait
+func (rl *RateLimiter) Allow(client string) time.Duration {
+	return rl.AllowN(client, 1)
+}
+
+// Takes n tokens of the client at once; returns 0 if there were enough, otherwise how long the client
+// should wait
+//   - n larger than the burst never fits, the client gets the wait for a full bucket
+func (rl *RateLimiter) AllowN(client string, n int) time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+
+	// a bucket that was refilled completely is the same as a new one ... sweep those once per refill
+	// time so the map doesn't grow with every client ever seen
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.lastSweep) > refill {
+		for key, b := range rl.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens + now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	needed := math.Min(float64(n), rl.burst)
+	if b.tokens < float64(n) {
+		return time.Duration((needed - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+
+	return 0
+}
+
+// Returns the client host of a request, without the port so that reconnects map to the same client
+func clientHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+//
+// Password complexity rules, enforced before hashing
+//   - Zero values disable a rule, so the zero value accepts any password
+//
+type PasswordRules struct {
+	MinLength int       // minimum number of characters
+	RequireUpper bool   // at least one upper case letter
+	RequireLower bool   // at least one lower case letter
+	RequireDigit bool   // at least one digit
+	RequireSymbol bool  // at least one punctuation character or symbol
+}
+
+// Returns the first rule the password violates or "" if it complies
+func (r PasswordRules) Check(pwd string) string {
+
+	if utf8.RuneCountInString(pwd) < r.MinLength {
+		return fmt.Sprintf("must be at least %d characters", r.MinLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range pwd {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			symbol = true
+		}
+	}
+
+	switch {
+	case r.RequireUpper && !upper:
+		return "must contain an upper case letter"
+	case r.RequireLower && !lower:
+		return "must contain a lower case letter"
+	case r.RequireDigit && !digit:
+		return "must contain a digit"
+	case r.RequireSymbol && !symbol:
+		return "must contain a symbol"
+	}
+
+	return ""
+}
+
+//
+// Handler Adapter
+//   - Wraps REST endpoints and delegates actual work (business logic) to a PasswordManagerInterface
+//   - Implemented as a type to allow different PasswordManager implementations
+//
+
+type PasswordManagerHandler struct {
+	PasswordManager PasswordManagerInterface
+	NotFoundStatus map[TaskState]int // HTTP status returned by GET /hash/<id> when no hash is available
+	PollLimiter *PollLimiter         // optional; rejects clients polling GET /hash/<id> too fast
+	RateLimiter *RateLimiter         // optional; rejects clients posting to /hash too fast
+	Metrics *Metrics                 // optional; serves /metrics and counts hash requests
+	MaxPasswordBytes int64           // larger POST /hash bodies and passwords are rejected with 413
+	PasswordRules PasswordRules      // complexity rules for POST /hash
+	Tenants map[string]PasswordManagerInterface // optional; separate managers selected by the X-Tenant header
+	UI bool                          // serve the manual hashing page on GET /ui
+	ShutdownMessage string           // body of responses rejected during shutdown
+	TagKey []byte                    // optional; key for the X-Hash-Tag integrity tag on retrieved hashes
+	CacheControl string              // Cache-Control header of GET /hash/<id> responses; empty omits it
+	TestMode bool                    // honor X-Hash-Delay on POST /hash; never enable in production
+	RequiredHeader string            // optional; requests without this header are rejected, e.g. one set by a gateway
+	RequiredHeaderValue []byte       // secret the RequiredHeader must carry
+	InstanceID string                // identifies this instance in /stats; defaults to the hostname
+	VerifyOnly bool                  // serve /verify only; nothing is hashed or stored
+	AdminToken []byte                // optional; bearer token for the /admin endpoints, which are off without it
+	OnShutdown func()                // optional; called once when a shutdown begins, before draining
+	ShutdownHookTimeout time.Duration // how long a shutdown waits for OnShutdown
+	ShutdownTimeout time.Duration    // how long a shutdown waits for pending hashes and open connections
+	adminMu *sync.Mutex              // serializes state changing admin operations and the start of a shutdown
+	shutdownOnce *sync.Once          // makes sure the shutdown sequence only runs once
+}
+
+const DefaultShutdownHookTimeout = 5*time.Second
+const DefaultShutdownTimeout = 30*time.Second
+const DefaultCacheControl = "no-store"
+
+const DefaultShutdownMessage = "Shutdown is pending - request rejected"
+const ShutdownRetryAfter = 30 // seconds, sent in Retry-After of requests rejected during shutdown
+
+// Error messages for tasks without a hash
+var notFoundMessages = map[TaskState]string{
+	TaskUnknown: "Hash not found",
+	TaskPending: "Hash not ready yet",
+	TaskGone:    "Hash already retrieved",
+	TaskFailed:  "Hash failed",
+	TaskCancelled: "Hash cancelled",
+	TaskDeleted: "Hash not found",
+}
+
+func NewPasswordManagerHandler(pm PasswordManagerInterface) (*PasswordManagerHandler) {
+	pwh := new(PasswordManagerHandler)
+	pwh.PasswordManager = pm
+	pwh.ShutdownMessage = DefaultShutdownMessage
+	pwh.ShutdownHookTimeout = DefaultShutdownHookTimeout
+	pwh.ShutdownTimeout = DefaultShutdownTimeout
+	pwh.MaxPasswordBytes = MaxBodyBytes
+	pwh.CacheControl = DefaultCacheControl
+	pwh.InstanceID, _ = os.Hostname() // empty if unknown
+	pwh.adminMu = new(sync.Mutex)
+	pwh.shutdownOnce = new(sync.Once)
+
+	// see -pending-status and -gone-status; 404 for everything matches the original behavior
+	pwh.NotFoundStatus = map[TaskState]int{
+		TaskUnknown: http.StatusNotFound,
+		TaskPending: http.StatusAccepted,
+		TaskGone:    http.StatusGone,
+		TaskFailed:  http.StatusInternalServerError,
+		TaskCancelled: http.StatusGone,
+		TaskDeleted: http.StatusNotFound, // as if it never existed
+	}
+
+	return pwh
+}
+
+// Helper that returns an HTTP error if shutdown is in progress
+func (pmh PasswordManagerHandler) isShutdownPending(w http.ResponseWriter) bool {
+
+	if pmh.PasswordManager.IsShuttingDown() {
+		pmh.rejectShutdown(w)
+		return true
+	}
+
+	return false
+}
+
+// Helper that rejects a request because of a shutdown; clients should retry, e.g. with another instance
+func (pmh PasswordManagerHandler) rejectShutdown(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(ShutdownRetryAfter))
+	pmh.writeError(w, pmh.ShutdownMessage, http.StatusServiceUnavailable)
+}
+
+// Helper that returns an HTTP error if the API is unavailable due to a shutdown or maintenance
+func (pmh PasswordManagerHandler) isUnavailable(w http.ResponseWriter) bool {
+
+	if pmh.isShutdownPending(w) {
+		return true
+	}
+
+	if pmh.PasswordManager.IsInMaintenance() {
+		pmh.writeError(w, "Service is under maintenance - request rejected", http.StatusServiceUnavailable)
+		return true
+	}
+
+	return false
+}
+
+// Helper that returns an HTTP error if the client exceeds its rate
+func (pmh PasswordManagerHandler) isRateLimited(w http.ResponseWriter, req *http.Request) bool {
+	return pmh.isRateLimitedN(w, req, 1)
+}
+
+// Same as isRateLimited for a request that counts as n, e.g. a batch of n passwords
+func (pmh PasswordManagerHandler) isRateLimitedN(w http.ResponseWriter, req *http.Request, n int) bool {
+
+	if pmh.RateLimiter == nil {
+		return false
+	}
+
+	if float64(n) > pmh.RateLimiter.burst {
+		pmh.writeError(w, fmt.Sprintf("Too many passwords for the rate limit (at most %v)", pmh.RateLimiter.burst),
+			http.StatusTooManyRequests)
+		return true
+	}
+	if wait := pmh.RateLimiter.AllowN(clientHost(req), n); wait > 0 {
+		retryAfter := int64((wait + time.Second - 1) / time.Second) // round up to full seconds
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		pmh.writeError(w, "Too many requests", http.StatusTooManyRequests)
+		return true
+	}
+
+	return false
+}
+
+// Helper that returns the manager for the tenant named in the X-Tenant header, or the default manager
+// if there is no header; returns an HTTP error for unknown tenants
+func (pmh PasswordManagerHandler) tenantManager(w http.ResponseWriter, req *http.Request) (PasswordManagerInterface, bool) {
+
+	tenant := req.Header.Get("X-Tenant")
+	if tenant == "" {
+		return pmh.PasswordManager, true
+	}
+
+	pm, ok := pmh.Tenants[tenant]
+	if !ok {
+		pmh.writeError(w, "Unknown tenant", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return pm, true
+}
+
+// Returns the default manager and all tenant managers
+func (pmh PasswordManagerHandler) managers() []PasswordManagerInterface {
+	pms := []PasswordManagerInterface{pmh.PasswordManager}
+	for _, pm := range pmh.Tenants {
+		pms = append(pms, pm)
+	}
+
+	return pms
+}
+
+// JSON body of error responses
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code int     `json:"code"`
+}
+
+// Helper that writes an HTTP error as JSON, like http.Error does with plain text
+func (pmh PasswordManagerHandler) writeError(w http.ResponseWriter, message string, code int) {
+	body, _ := json.Marshal(ErrorResponse{Error: message, Code: code}) // can't fail for a string and an int
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// Helper that returns the configured HTTP error for a task that has no hash (yet)
+//   - a pending hash answered with a 2xx, e.g. the default 202, isn't an error; it gets the body of
+//     GET /hash/<id>/status instead
+func (pmh PasswordManagerHandler) hashNotFound(w http.ResponseWriter, state TaskState) {
+
+	status, ok := pmh.NotFoundStatus[state]
+	if !ok {
+		status = http.StatusNotFound
+	}
+
+	if state == TaskPending && status >= 200 && status < 300 {
+		writeReady(w, false, status)
+		return
+	}
+
+	pmh.writeError(w, notFoundMessages[state], status)
+}
+
+// Helper that writes whether a hash is ready, as JSON
+func writeReady(w http.ResponseWriter, ready bool, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write([]byte(fmt.Sprintf("{\"ready\": %t}", ready)))
+}
+
+// POST /hash
+func (pmh PasswordManagerHandler) hash(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+	pmh.Metrics.hashRequested()
+
+	if pmh.isRateLimited(w, req) {
+		return
+	}
+
+	body, err := readBodyLimit(w, req, pmh.MaxPasswordBytes) // the password can't be larger than the body
+	if req.Context().Err() != nil { // client is gone, nobody to answer
+		return
+	}
+	if err == errBodyTooLarge {
+		pmh.writeError(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == errUnsupportedEncoding {
+		pmh.writeError(w, "Unsupported content encoding ('gzip' or none required)", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil || len(body) == 0 {
+		pmh.writeError(w, "Can't read body", http.StatusBadRequest)
+		return
+	}
+
+	pwd, err := parsePassword(req.Header.Get("Content-Type"), body)
+	if err == errUnsupportedMediaType {
+		pmh.writeError(w, "Unsupported content type ('application/x-www-form-urlencoded' or 'application/json' required)", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+		return
+	}
+	if int64(len(pwd)) > pmh.MaxPasswordBytes { // checked like a batch, whatever the body encoding
+		pmh.writeError(w, "Password too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if rule := pmh.PasswordRules.Check(pwd); rule != "" {
+		pmh.writeError(w, "Password "+rule, http.StatusUnprocessableEntity)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	if pm.BudgetExceeded() {
+		pmh.writeError(w, "Hashing budget exhausted - request rejected", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := req.Header.Get("Idempotency-Key")
+	if len(key) > MaxIdempotencyKeyBytes {
+		pmh.writeError(w, "Idempotency-Key too long", http.StatusBadRequest)
+		return
+	}
+
+	// delegate actual work; integration tests can override the nap per request to exercise client timeouts
+	var id int64
+	repeated := false
+	if delay := req.Header.Get("X-Hash-Delay"); pmh.TestMode && delay != "" {
+		nap, err := time.ParseDuration(delay)
+		if err != nil || nap < 0 {
+			pmh.writeError(w, "Invalid X-Hash-Delay", http.StatusBadRequest)
+			return
+		}
+		id = pm.HashWithDelay(pwd, nap)
+	} else {
+		// not req.Context(): net/http cancels it as soon as the handler returns, i.e. right after the id is
+		// sent and long before the nap is over, so it would cancel every hash. A client that no longer
+		// wants the hash discards it with DELETE /hash/<id>; only the context's values are passed on
+		id, repeated, _ = pm.HashIdempotent(context.WithoutCancel(req.Context()), key, pwd)
+	}
+	switch id {
+	case HashBusy:
+		pmh.writeError(w, "Too many pending hashes - request rejected", http.StatusTooManyRequests)
+		return
+	case HashShuttingDown: // the shutdown began after isUnavailable
+		pmh.rejectShutdown(w)
+		return
+	}
+
+	// old clients expect the bare id and can still ask for it
+	var res []byte
+	if prefersPlainText(req.Header.Get("Accept")) {
+		res = []byte(strconv.FormatInt(id, 10))
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	} else {
+		res, err = json.Marshal(HashResponse{ID: id})
+		if err != nil {
+			pmh.writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	w.Header().Set("Location", "/hash/"+strconv.FormatInt(id, 10)) // where to poll for the hash
+	setExpires(w, pm.ExpiresAt(id))
+	if repeated {
+		w.WriteHeader(http.StatusOK) // retry of a request that already started the hash
+	} else {
+		w.WriteHeader(http.StatusAccepted) // resource not yet created
+	}
+	w.Write(res)
+
+	// TODO securely destroy password
+}
+
+// Indicates if an Accept header asks for text/plain before application/json
+//   - the first of the two media types listed wins; quality values aren't weighed, clients that want the
+//     bare id just send 'Accept: text/plain'
+func prefersPlainText(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		switch strings.ToLower(mediaType) {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+
+	return false
+}
+
+// JSON body of POST /hash/batch
+type BatchHashRequest struct {
+	Passwords []string `json:"passwords"`
+}
+
+// JSON body of a successful POST /hash/batch
+type BatchHashResponse struct {
+	IDs []int64 `json:"ids"`
+}
+
+// POST /hash/batch
+//   - starts a hash per password, all or none; 429 if there aren't enough free workers for all of them
+//   - each password counts against the rate limit
+func (pmh PasswordManagerHandler) batch(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		pmh.writeError(w, "Unsupported content type ('application/json' required)", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readBodyLimit(w, req, MaxBatchSize*pmh.MaxPasswordBytes)
+	if req.Context().Err() != nil { // client is gone, nobody to answer
+		return
+	}
+	if err == errBodyTooLarge {
+		pmh.writeError(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == errUnsupportedEncoding {
+		pmh.writeError(w, "Unsupported content encoding ('gzip' or none required)", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		pmh.writeError(w, "Can't read body", http.StatusBadRequest)
+		return
+	}
+
+	var batch BatchHashRequest
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch.Passwords) == 0 {
+		pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Passwords) > MaxBatchSize {
+		pmh.writeError(w, fmt.Sprintf("Too many passwords (at most %d)", MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+	for i, pwd := range batch.Passwords {
+		if pwd == "" {
+			pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+			return
+		}
+		if int64(len(pwd)) > pmh.MaxPasswordBytes {
+			pmh.writeError(w, fmt.Sprintf("Password %d too large", i), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if rule := pmh.PasswordRules.Check(pwd); rule != "" {
+			pmh.writeError(w, fmt.Sprintf("Password %d %s", i, rule), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if pmh.isRateLimitedN(w, req, len(batch.Passwords)) {
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	if pm.BudgetExceeded() {
+		pmh.writeError(w, "Hashing budget exhausted - request rejected", http.StatusServiceUnavailable)
+		return
+	}
+
+	ids, err := pm.HashBatch(batch.Passwords)
+	switch err {
+	case ErrBatchTooLarge:
+		pmh.writeError(w, "Too many passwords for the workers", http.StatusBadRequest)
+		return
+	case ErrHashBusy:
+		pmh.writeError(w, "Too many pending hashes - request rejected", http.StatusTooManyRequests)
+		return
+	case ErrShuttingDown: // the shutdown began after isUnavailable; none of the hashes started
+		pmh.rejectShutdown(w)
+		return
+	}
+
+	res, err := json.Marshal(BatchHashResponse{IDs: ids})
+	if err != nil {
+		pmh.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted) // resources not yet created
+	w.Write(res)
+}
+
+// Returns the id of a /hash/<id> request
+//   - Only looks at the path, which never includes the query, so parameters like ?encoding=hex don't
+//     end up in the id
+func parseHashID(req *http.Request) (int64, error) {
+	return parseHashIDPath(req.URL.Path)
+}
+
+// Returns the id of a /hash/<id> path
+func parseHashIDPath(path string) (int64, error) {
+	ids := strings.TrimPrefix(path, "/hash/") // strip /hash/ from /hash/1245; slicing panics on /hash
+	if ids == "" || ids == path {
+		return 0, errors.New("no hash id")
+	}
+
+	return strconv.ParseInt(ids, 10, 64)
+}
+
+var errBodyTooLarge = errors.New("body too large")
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+var errUnsupportedMediaType = errors.New("unsupported content type")
+var errInvalidParameters = errors.New("invalid parameters")
+
+// Helper that reads the body of the verify endpoints, which carry a password and a hash, tag or id; returns
+// an HTTP error if it can't be read
+func (pmh PasswordManagerHandler) readVerifyBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+
+	body, err := readBodyLimit(w, req, pmh.MaxPasswordBytes+VerifyBodyOverhead)
+	switch {
+	case err == errBodyTooLarge:
+		pmh.writeError(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	case err == errUnsupportedEncoding:
+		pmh.writeError(w, "Unsupported content encoding ('gzip' or none required)", http.StatusUnsupportedMediaType)
+		return nil, false
+	case err != nil:
+		pmh.writeError(w, "Can't read body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// Helper that reads the request body once, capped at limit bytes, so that it can be parsed several ways
+//   - the cap applies to the body as sent, so that huge bodies never get buffered, and to the decompressed size of
+//     gzip bodies to guard against zip bombs
+func readBodyLimit(w http.ResponseWriter, req *http.Request, limit int64) ([]byte, error) {
+
+	var reader io.Reader = ctxReader{req.Context(), http.MaxBytesReader(w, req.Body, limit)}
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, errBodyTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+
+	return body, nil
+}
+
+// Reader that stops once ctx is done, so that a client disconnecting mid-body doesn't keep the handler reading
+type ctxReader struct {
+	ctx context.Context
+	r io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+// JSON body of POST /hash
+type HashRequest struct {
+	Password string `json:"password"`
+}
+
+// JSON body of a successful POST /hash
+type HashResponse struct {
+	ID int64 `json:"id"`
+}
+
+// Extracts the password from a hash request body of the given Content-Type
+//   - forms are URL encoded, so '&' and '%' in passwords need escaping; '=' doesn't. Parsed like
+//     req.ParseForm does, but from the body readBodyLimit already read and decompressed
+//   - JSON bodies are a HashRequest
+//   - anything else, including a missing Content-Type, is an errUnsupportedMediaType
+func parsePassword(contentType string, body []byte) (string, error) {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errUnsupportedMediaType
+	}
+
+	var pwd string
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", errInvalidParameters
+		}
+		pwd = form.Get("password")
+
+	case "application/json":
+		var hashReq HashRequest
+		if err := json.Unmarshal(body, &hashReq); err != nil {
+			return "", errInvalidParameters
+		}
+		pwd = hashReq.Password
+
+	default:
+		return "", errUnsupportedMediaType
+	}
+
+	if len(pwd) == 0 {
+		return "", errInvalidParameters
+	}
+
+	return pwd, nil
+}
+
+// GET /hash/<id>
+func (pmh PasswordManagerHandler) get(w http.ResponseWriter, req *http.Request) {
+
+	// keep proxies from caching digests (or a 404 that's about to turn into one)
+	if pmh.CacheControl != "" {
+		w.Header().Set("Cache-Control", pmh.CacheControl)
+	}
+
+	// Spec didn't say if /get should be prevented as well
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseHashID(req)
+	if err != nil {
+		pmh.writeError(w, "Invalid method resource id", http.StatusBadRequest)
+		return
+	}
+
+	if pmh.PollLimiter != nil {
+		if wait := pmh.PollLimiter.Allow(clientHost(req), req.Header.Get("X-Tenant"), id); wait > 0 {
+			retryAfter := int64((wait + time.Second - 1) / time.Second) // round up to full seconds
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			pmh.writeError(w, "Polling too fast", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// the hash is consumed unless the client asks to keep it, e.g. to fetch it again later
+	consume := true
+	if param := req.URL.Query().Get("consume"); param != "" {
+		consume, err = strconv.ParseBool(param)
+		if err != nil {
+			pmh.writeError(w, "Invalid consume parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	polls := pm.PendingPolls(id) // before Get, which drops the count when it returns the hash
+	var pwdHash []byte
+	var state TaskState
+	if consume {
+		pwdHash, state = pm.Get(id)
+	} else if pwdHash, _ = pm.Peek(id); pwdHash == nil {
+		state = pm.State(id)
+		if state == TaskReady { // completed between Peek and State ... it was still pending when Peek looked
+			state = TaskPending
+		}
+	}
+
+	if pwdHash == nil {
+		pmh.hashNotFound(w, state)
+		return
+	}
+
+	w.Header().Set("X-Pending-Polls", strconv.Itoa(polls)) // helps diagnosing clients that poll too eagerly
+
+	if len(pmh.TagKey) > 0 {
+		w.Header().Set("X-Hash-Tag", base64.StdEncoding.EncodeToString(hashTag(pmh.TagKey, pwdHash)))
+	}
+
+	writeHash(w, pwdHash)
+}
+
+// Dispatches requests below /hash/
+func (pmh PasswordManagerHandler) hashResource(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/status") {
+		pmh.status(w, req)
+		return
+	}
+	switch req.URL.Path {
+	case "/hash/batch":
+		pmh.batch(w, req)
+		return
+	case "/hash/verify":
+		pmh.verifyID(w, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodDelete:
+		pmh.delete(w, req)
+	case http.MethodHead:
+		pmh.head(w, req)
+	default:
+		pmh.get(w, req)
+	}
+}
+
+// HEAD /hash/<id>
+//   - polls readiness like GET without consuming the hash: 200 if it's ready, the status GET would return
+//     otherwise; never a body
+func (pmh PasswordManagerHandler) head(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.CacheControl != "" {
+		w.Header().Set("Cache-Control", pmh.CacheControl)
+	}
+
+	if pmh.PasswordManager.IsShuttingDown() || pmh.PasswordManager.IsInMaintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	id, err := parseHashID(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	if pwdHash, _ := pm.Peek(id); pwdHash != nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	state := pm.State(id)
+	if state == TaskReady { // completed between Peek and State
+		state = TaskPending
+	}
+	status, ok := pmh.NotFoundStatus[state]
+	if !ok {
+		status = http.StatusNotFound
+	}
+	w.WriteHeader(status)
+}
+
+// DELETE /hash/<id>
+//   - frees a hash the client doesn't need anymore
+func (pmh PasswordManagerHandler) delete(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	id, err := parseHashID(req)
+	if err != nil {
+		pmh.writeError(w, "Invalid method resource id", http.StatusBadRequest)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	if !pm.Delete(id) {
+		pmh.writeError(w, notFoundMessages[TaskUnknown], http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /hash/<id>/status
+//   - tells if the hash is ready without consuming it
+func (pmh PasswordManagerHandler) status(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.CacheControl != "" { // readiness changes
+		w.Header().Set("Cache-Control", pmh.CacheControl)
+	}
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseHashIDPath(strings.TrimSuffix(req.URL.Path, "/status"))
+	if err != nil {
+		pmh.writeError(w, "Invalid method resource id", http.StatusBadRequest)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	pwdHash, exists := pm.Peek(id)
+	if !exists {
+		pmh.hashNotFound(w, pm.State(id))
+		return
+	}
+
+	setExpires(w, pm.ExpiresAt(id))
+	writeReady(w, pwdHash != nil, http.StatusOK)
+}
+
+// Helper that tells clients by when to retrieve a hash with an Expires header, unless it never expires
+func setExpires(w http.ResponseWriter, expiresAt time.Time) {
+	if !expiresAt.IsZero() {
+		w.Header().Set("Expires", expiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Buffers for base64 encoding hashes; pooled so that concurrent fetches don't allocate one each
+var encodeBuffers = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// Helper that writes the base64 encoded hash, buffered so that Content-Length can be set
+func writeHash(w http.ResponseWriter, pwdHash []byte) {
+
+	buf := encodeBuffers.Get().(*[]byte)
+	defer encodeBuffers.Put(buf)
+
+	n := base64.StdEncoding.EncodedLen(len(pwdHash))
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	encoded := (*buf)[:n]
+	base64.StdEncoding.Encode(encoded, pwdHash)
+
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	w.Write(encoded)
+}
+
+
+// JSON body of GET /health
+type HealthResponse struct {
+	Status string `json:"status"`
+	PendingHashes int `json:"pending_hashes"`
+	ShuttingDown bool `json:"shutting_down"`
+}
+
+// GET /health
+//   - lets load balancers stop routing traffic once a shutdown begins; ignores maintenance, which is planned
+//     and temporary
+//   - always answers JSON, errors included
+func (pmh PasswordManagerHandler) health(w http.ResponseWriter, req *http.Request) {
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := HealthResponse{Status: "ok"}
+	code := http.StatusOK
+	if pmh.PasswordManager.IsShuttingDown() {
+		res.Status, res.ShuttingDown = "draining", true
+		code = http.StatusServiceUnavailable
+	}
+
+	for _, pm := range pmh.managers() {
+		res.PendingHashes += pm.PendingCount()
+	}
+
+	body, _ := json.Marshal(res) // can't fail for a string, an int and a bool
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// GET /live
+//   - liveness probe; answering at all shows that the server loop is running, so it's always 200, even
+//     while shutting down
+func (pmh PasswordManagerHandler) live(w http.ResponseWriter, req *http.Request) {
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte("{\"status\": \"ok\"}"))
+}
+
+// GET /ready
+//   - readiness probe; 503 once a shutdown begins, while all workers are busy or when the latest store write
+//     failed, so that orchestrators route new hashes elsewhere without restarting the instance
+//   - ?verbose=true answers a ReadyReport with each check, with the same status code
+func (pmh PasswordManagerHandler) ready(w http.ResponseWriter, req *http.Request) {
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	verbose := false
+	if param := req.URL.Query().Get("verbose"); param != "" {
+		var err error
+		verbose, err = strconv.ParseBool(param)
+		if err != nil {
+			pmh.writeError(w, "Invalid verbose parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if verbose {
+		report := pmh.readiness()
+		body, _ := json.Marshal(report) // can't fail for strings and bools
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if report.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+		return
+	}
+
+	if pmh.PasswordManager.IsShuttingDown() {
+		pmh.rejectShutdown(w)
+		return
+	}
+	if pmh.PasswordManager.IsSaturated() {
+		pmh.writeError(w, "Too many pending hashes", http.StatusServiceUnavailable)
+		return
+	}
+	if pmh.storeError() != nil {
+		pmh.writeError(w, "Store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte("{\"status\": \"ready\"}"))
+}
+
+// JSON body of GET /ready?verbose=true
+type ReadyReport struct {
+	Status string `json:"status"` // ready or unavailable
+	Checks []ReadyCheck `json:"checks"`
+}
+
+// Sub-check of a ReadyReport
+type ReadyCheck struct {
+	Name string `json:"name"`
+	OK bool `json:"ok"`
+	Error string `json:"error,omitempty"` // why it isn't ok
+}
+
+// Runs the checks of GET /ready
+func (pmh PasswordManagerHandler) readiness() ReadyReport {
+	check := func(name string, failure string) ReadyCheck {
+		return ReadyCheck{Name: name, OK: failure == "", Error: failure}
+	}
+
+	shutdown, pool, store := "", "", ""
+	if pmh.PasswordManager.IsShuttingDown() {
+		shutdown = "shutdown is in progress"
+	}
+	if pmh.PasswordManager.IsSaturated() {
+		pool = "all workers are busy"
+	}
+	if err := pmh.storeError(); err != nil {
+		store = err.Error()
+	}
+
+	report := ReadyReport{Status: "ready", Checks: []ReadyCheck{
+		check("shutdown", shutdown), check("pool", pool), check("store", store)}}
+	for _, c := range report.Checks {
+		if !c.OK {
+			report.Status = "unavailable"
+		}
+	}
+
+	return report
+}
+
+// Returns the error of the latest store write of any manager
+func (pmh PasswordManagerHandler) storeError() error {
+	for _, pm := range pmh.managers() {
+		if err := pm.StoreError(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GET /stats
+//   - ?quantiles=0.5,0.9,0.99 adds the interpolated quantiles of the latest hash durations
+func (pmh PasswordManagerHandler) stats(w http.ResponseWriter, req *http.Request) {
+
+	// Spec didn't say if /stats should be prevented as well
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	approx := false
+	if param := req.URL.Query().Get("approx"); param != "" {
+		var err error
+		approx, err = strconv.ParseBool(param)
+		if err != nil {
+			pmh.writeError(w, "Invalid approx parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var qs []float64
+	if param := req.URL.Query().Get("quantiles"); param != "" {
+		var err error
+		qs, err = parseQuantiles(param)
+		if err != nil {
+			pmh.writeError(w, "Invalid quantiles parameter ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		if approx { // the lock free stats keep no samples
+			pmh.writeError(w, "Quantiles aren't available with approx", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	// lets collectors attribute stats from a fleet of instances
+	instance, _ := json.Marshal(pmh.InstanceID)
+	source := fmt.Sprintf("\"instance\": %s, \"timestamp\": \"%s\"", instance, time.Now().UTC().Format(time.RFC3339))
+
+	// lock free and slightly stale; the other stats need the lock, so they're left out
+	if approx {
+		requests, avgTime := pm.ApproxStats()
+		w.Write([]byte(fmt.Sprintf("{\"total\": %d, \"average\": %d, %s}", requests, avgTime, source)))
+		return
+	}
+
+	stats := pm.StatsDetailed()
+	unretrieved := pm.UnretrievedCount() // a growing number hints at clients not fetching results
+	throughput := pm.Throughput()
+
+	// in milliseconds like the other durations, keyed by the quantile as requested
+	if qs != nil {
+		values := pm.Quantiles(qs)
+		quantiles := make([]string, len(qs))
+		for i, q := range qs {
+			quantiles[i] = fmt.Sprintf("\"%s\": %.3f", strconv.FormatFloat(q, 'g', -1, 64),
+				float64(values[i]) / float64(time.Millisecond))
+		}
+		source = "\"quantiles\": {" + strings.Join(quantiles, ", ") + "}, " + source
+	}
+
+	// JSON is very simple ... therefore just create a string
+	body := fmt.Sprintf("{\"total\": %d, \"average\": %d, \"pending\": %d, \"min\": %d, \"max\": %d, \"p50\": %d, \"p95\": %d, "+
+		"\"unretrieved\": %d, \"evicted\": %d, \"throughput_per_sec\": %.2f, %s}",
+		stats.Total, stats.Average, stats.Pending, stats.Min, stats.Max, stats.P50, stats.P95, unretrieved, stats.Evicted,
+		throughput, source)
+	w.Write([]byte(body))
+}
+
+// Parses the comma separated quantiles of GET /stats, each from 0 to 1
+func parseQuantiles(param string) ([]float64, error) {
+	fields := strings.Split(param, ",")
+	if len(fields) > MaxQuantiles {
+		return nil, fmt.Errorf("at most %d", MaxQuantiles)
+	}
+
+	qs := make([]float64, len(fields))
+	for i, field := range fields {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || !(q >= 0 && q <= 1) { // also rejects NaN
+			return nil, fmt.Errorf("'%s' isn't a number from 0 to 1", field)
+		}
+		qs[i] = q
+	}
+
+	return qs, nil
+}
+
+// Returns the HMAC-SHA256 tag over a hash, lets clients detect a hash that was modified in transit
+func hashTag(key []byte, pwdHash []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pwdHash)
+
+	return mac.Sum(nil)
+}
+
+// Checks a tag in constant time
+func checkHashTag(key []byte, pwdHash []byte, tag []byte) bool {
+	return hmac.Equal(hashTag(key, pwdHash), tag)
+}
+
+// POST /verify-tag
+//  - Body is {"hash": "<base64>", "tag": "<base64>"} as returned by GET /hash/<id> and X-Hash-Tag
+func (pmh PasswordManagerHandler) verifyTag(w http.ResponseWriter, req *http.Request) {
+
+	if len(pmh.TagKey) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := pmh.readVerifyBody(w, req)
+	if !ok {
+		return
+	}
+
+	var tagged struct {
+		Hash []byte `json:"hash"` // encoding/json decodes base64 into []byte
+		Tag []byte `json:"tag"`
+	}
+	if err := json.Unmarshal(body, &tagged); err != nil || len(tagged.Hash) == 0 || len(tagged.Tag) == 0 {
+		pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+		return
+	}
+
+	body = []byte(fmt.Sprintf("{\"valid\": %t}", checkHashTag(pmh.TagKey, tagged.Hash, tagged.Tag)))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(body)
+}
+
+// POST /verify
+//   - recomputes the hash of {"password": "<pwd>", "hash": "<base64 of a hash from GET /hash/<id>>"} and
+//     compares it in constant time; stateless, so it works in -verify-only mode
+//   - rate limited like POST /hash, and shares the workers with it; 429 once they're all busy
+func (pmh PasswordManagerHandler) verify(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if pmh.isRateLimited(w, req) {
+		return
+	}
+
+	body, ok := pmh.readVerifyBody(w, req)
+	if !ok {
+		return
+	}
+
+	var verifyReq struct {
+		Password string `json:"password"`
+		Hash []byte `json:"hash"` // encoding/json decodes base64 into []byte
+	}
+	if err := json.Unmarshal(body, &verifyReq); err != nil || len(verifyReq.Password) == 0 || len(verifyReq.Hash) == 0 {
+		pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+		return
+	}
+	if int64(len(verifyReq.Password)) > pmh.MaxPasswordBytes {
+		pmh.writeError(w, "Password too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := CheckHashCost(verifyReq.Hash); err != nil {
+		pmh.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := pmh.PasswordManager.VerifyHash(verifyReq.Password, verifyReq.Hash)
+	if err == ErrHashBusy {
+		pmh.writeError(w, "Too many pending hashes - request rejected", http.StatusTooManyRequests)
+		return
+	}
+
+	body = []byte(fmt.Sprintf("{\"valid\": %t}", valid))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(body)
+}
+
+// JSON body of POST /hash/verify
+type VerifyIDRequest struct {
+	ID int64 `json:"id"`
+	Password string `json:"password"`
+}
+
+// POST /hash/verify
+//   - checks a password against a stored hash, which stays stored; spares clients from fetching the hash and
+//     comparing it themselves
+//   - rate limited like POST /hash, and a hash refuses further checks with 429 after MaxVerifyFailures
+//     mismatches
+func (pmh PasswordManagerHandler) verifyID(w http.ResponseWriter, req *http.Request) {
+
+	if pmh.isUnavailable(w) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if pmh.isRateLimited(w, req) {
+		return
+	}
+
+	body, ok := pmh.readVerifyBody(w, req)
+	if !ok {
+		return
+	}
+
+	var verifyReq VerifyIDRequest
+	if err := json.Unmarshal(body, &verifyReq); err != nil || len(verifyReq.Password) == 0 {
+		pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+		return
+	}
+	if int64(len(verifyReq.Password)) > pmh.MaxPasswordBytes {
+		pmh.writeError(w, "Password too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	match, err := pm.Verify(verifyReq.ID, verifyReq.Password)
+	if err == ErrTooManyFailures {
+		pmh.writeError(w, "Too many failed verifications of this hash", http.StatusTooManyRequests)
+		return
+	}
+
+	body = []byte(fmt.Sprintf("{\"match\": %t}", match))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(body)
+}
+
+// Page for manual hashing ... submits to /hash and polls /hash/<id> until the hash is ready
+const uiPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password Service</title></head>
+<body>
+<h1>Password Service</h1>
+<form id="form">
+	<input type="password" id="password" placeholder="Password" autofocus>
+	<button type="submit">Hash</button>
+</form>
+<pre id="result"></pre>
+<script>
+const result = document.getElementById("result");
+
+async function errorText(res) {
+	const body = await res.text();
+	try {
+		return "Error: " + JSON.parse(body).error;
+	} catch (e) {
+		return "Error: " + body;
+	}
+}
+
+async function poll(id) {
+	const res = await fetch("/hash/" + id);
+	if (res.status === 202 || res.status === 425) {
+		setTimeout(() => poll(id), 1000);
+	} else if (res.ok) {
+		result.textContent = await res.text();
+	} else {
+		result.textContent = await errorText(res);
+	}
+}
+
+document.getElementById("form").addEventListener("submit", async (e) => {
+	e.preventDefault();
+	result.textContent = "Hashing ...";
+	const res = await fetch("/hash", {
+		method: "POST",
+		headers: {"Content-Type": "application/x-www-form-urlencoded"},
+		body: "password=" + encodeURIComponent(document.getElementById("password").value),
+	});
+	if (res.status !== 202) {
+		result.textContent = await errorText(res);
+		return;
+	}
+	const body = await res.json();
+	setTimeout(() => poll(body.id), 1000);
+});
+</script>
+</body>
+</html>
+`
+
+// GET /ui
+func (pmh PasswordManagerHandler) ui(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.UI {
+		http.NotFound(w, req)
+		return
+	}
+
+	// sanity checks
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Write([]byte(uiPage))
+}
+
+// GET|POST /admin/maintenance
+//  - POST with enabled=true|false toggles maintenance mode, GET reports it
+//  - Stays available during maintenance, otherwise it couldn't be turned off again
+func (pmh PasswordManagerHandler) maintenance(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.isAdmin(w, req) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			pmh.writeError(w, "Invalid parameters", http.StatusBadRequest)
+			return
+		}
+
+		pmh.adminMu.Lock()
+		defer pmh.adminMu.Unlock()
+
+		if pmh.isShutdownPending(w) { // a shutdown can't be undone, so don't pretend to change anything
+			return
+		}
+		pmh.PasswordManager.SetMaintenance(on)
+	default:
+		pmh.writeError(w, "Invalid method ('GET' or 'POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := fmt.Sprintf("{\"maintenance\": %t}", pmh.PasswordManager.IsInMaintenance())
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte(body))
+}
+
+// POST /admin/stats/reset
+func (pmh PasswordManagerHandler) resetStats(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.isAdmin(w, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	// either the reset happens before the shutdown starts or it's rejected, never halfway
+	pmh.adminMu.Lock()
+	defer pmh.adminMu.Unlock()
+
+	if pmh.isShutdownPending(w) {
+		return
+	}
+	pm.ResetStats()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/budget/reset
+func (pmh PasswordManagerHandler) resetBudget(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.isAdmin(w, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	pmh.adminMu.Lock()
+	defer pmh.adminMu.Unlock()
+
+	if pmh.isShutdownPending(w) {
+		return
+	}
+	pm.ResetBudget()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Helper that returns an HTTP error unless the request carries the admin token
+//   - endpoints guarded by it don't exist without a token
+func (pmh PasswordManagerHandler) isAdmin(w http.ResponseWriter, req *http.Request) bool {
+
+	if len(pmh.AdminToken) == 0 {
+		http.NotFound(w, req)
+		return false
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), pmh.AdminToken) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		pmh.writeError(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// GET /admin/export
+func (pmh PasswordManagerHandler) export(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.isAdmin(w, req) {
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		pmh.writeError(w, "Invalid method ('GET' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(pm.Export())
+	if err != nil {
+		pmh.writeError(w, "Can't export hashes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(body)
+}
+
+// POST /admin/import
+//   - takes the body of GET /admin/export
+func (pmh PasswordManagerHandler) importTasks(w http.ResponseWriter, req *http.Request) {
+
+	if !pmh.isAdmin(w, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		pmh.writeError(w, "Invalid method ('POST' required)", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pm, ok := pmh.tenantManager(w, req)
+	if !ok {
+		return
+	}
+
+	body, err := readBodyLimit(w, req, MaxImportBytes) // exports are much larger than hash requests
+	if err == errBodyTooLarge {
+		pmh.writeError(w, "Export too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var export TaskExport
+	if err != nil || json.Unmarshal(body, &export) != nil {
+		pmh.writeError(w, "Invalid export", http.StatusBadRequest)
+		return
+	}
+
+	pmh.adminMu.Lock()
+	defer pmh.adminMu.Unlock()
+
+	if pmh.isShutdownPending(w) {
+		return
+	}
+	if err := pm.Import(export); err != nil {
+		pmh.writeError(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Initiate a graceful shutdown
+func (pmh PasswordManagerHandler) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), pmh.ShutdownTimeout)
+	defer cancel()
+
+	pmh.shutdownCtx(ctx)
+}
+
+// Same as shutdown, but waits for pending hashes only until ctx is done
+func (pmh PasswordManagerHandler) shutdownCtx(ctx context.Context) {
+	pmh.shutdownOnce.Do(func() { pmh.runShutdown(ctx) })
+}
+
+func (pmh PasswordManagerHandler) runShutdown(ctx context.Context) {
+
+	slog.Info("shutting down")
+	pmh.adminMu.Lock()
+	for _, pm := range pmh.managers() {
+		pm.Shutdown()
+	}
+	pmh.adminMu.Unlock()
+
+	// e.g. deregister from service discovery; bounded so a hanging hook can't block the shutdown
+	if pmh.OnShutdown != nil {
+		done := make(chan struct{})
+		go func() {
+			pmh.OnShutdown()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(pmh.ShutdownHookTimeout):
+			slog.Warn("shutdown hook timed out", "timeout", pmh.ShutdownHookTimeout)
+		case <-ctx.Done():
+			slog.Warn("shutdown hook timed out", "timeout", pmh.ShutdownTimeout)
+		}
+	}
+
+	if pending := pmh.waitForPendingHashes(ctx); pending > 0 {
+		slog.Warn("shutdown timed out, abandoning pending hashes", "pending", pending)
+	}
+
+	slog.Info("shutdown done")
+}
+
+// Returns an OnShutdown hook that POSTs to hookURL, e.g. to deregister from service discovery
+//   - the request is cancelled after timeout, runShutdown stops waiting for it then anyway
+func shutdownHook(hookURL string, timeout time.Duration) func() {
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, nil)
+		if err != nil {
+			slog.Warn("shutdown hook failed", "url", hookURL, "error", err)
+			return
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			slog.Warn("shutdown hook failed", "url", hookURL, "error", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			slog.Warn("shutdown hook failed", "url", hookURL, "status", res.StatusCode)
+		}
+	}
+}
+
+// Shuts down the service, then the server
+//   - from the start of the shutdown the API answers 503, polls for hashes included; requests already
+//     being handled complete. Once the hashes drained the server closes its listeners and waits for the
+//     open connections
+//   - both waits share a single ShutdownTimeout
+func (pmh PasswordManagerHandler) shutdownServer(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pmh.ShutdownTimeout)
+	defer cancel()
+
+	pmh.shutdownCtx(ctx)
+
+	return srv.Shutdown(ctx)
+}
+
+// Waits until all managers drained their pending hashes or ctx is done
+//   - returns the number of hashes still pending, 0 if all drained
+func (pmh PasswordManagerHandler) waitForPendingHashes(ctx context.Context) int {
+	for _, pm := range pmh.managers() {
+		select {
+		case <-pm.Drained():
+		case <-ctx.Done():
+			pending := 0
+			for _, pm := range pmh.managers() {
+				pending += pm.PendingCount()
+			}
+			return pending
+		}
+	}
+
+	return 0
+}
+
+
+//
+// StatsD reporter
+//   - Periodically pushes the stats of a PasswordManagerInterface, and of its tenants, to a StatsD daemon
+//     over UDP
+//
+
+type StatsdReporter struct {
+	PasswordManager PasswordManagerInterface
+	Tenants map[string]PasswordManagerInterface // optional; reported with a tenant tag
+	conn net.Conn
+	prefix string            // prepended to all metric names
+	interval time.Duration   // time between two reports
+	last map[string]statsdTotal // totals at the last report per tenant, "" for the default manager
+	quit chan struct{}
+}
+
+// Total of a manager at a report, to send the number of new hashes as a counter
+type statsdTotal struct {
+	total int64
+	resets int64 // DetailedStats.Resets; the total restarted from 0 if it changed
+}
+
+func NewStatsdReporter(pm PasswordManagerInterface, addr string, prefix string, interval time.Duration) (*StatsdReporter, error) {
+	conn, err := net.Dial("udp", addr) // UDP, so this doesn't fail if the daemon isn't up (yet)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsdReporter{PasswordManager: pm, conn: conn, prefix: prefix, interval: interval,
+		last: make(map[string]statsdTotal), quit: make(chan struct{})}, nil
+}
+
+// Start reporting in the background
+func (sr *StatsdReporter) Start() {
+	go func() {
+		ticker := time.NewTicker(sr.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sr.report()
+			case <-sr.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop reporting and close the connection
+func (sr *StatsdReporter) Stop() {
+	close(sr.quit)
+	sr.conn.Close()
+}
+
+// Report every manager; errors are ignored since StatsD is fire and forget anyway
+func (sr *StatsdReporter) report() {
+	sr.reportManager("", sr.PasswordManager)
+	for tenant, pm := range sr.Tenants {
+		sr.reportManager(tenant, pm)
+	}
+}
+
+// Send the metrics of a manager in a single datagram; tenants get a DogStatsD style tenant tag, the default
+// manager none, so its metrics stay the same without tenants
+func (sr *StatsdReporter) reportManager(tenant string, pm PasswordManagerInterface) {
+
+	stats := pm.StatsDetailed()
+	last := sr.last[tenant]
+	if stats.Resets != last.resets { // the stats were reset since the last report
+		last.total = 0
+	}
+
+	tag := ""
+	if tenant != "" {
+		tag = "|#tenant:" + tenant
+	}
+
+	// total is a gauge since it's absolute; the counter carries the increase since the last report. p95 is
+	// already aggregated over the latest hashes, so it's a gauge too
+	lines := []string{
+		fmt.Sprintf("%s.hashes:%d|c%s", sr.prefix, stats.Total-last.total, tag),
+		fmt.Sprintf("%s.total:%d|g%s", sr.prefix, stats.Total, tag),
+		fmt.Sprintf("%s.pending:%d|g%s", sr.prefix, stats.Pending, tag),
+		fmt.Sprintf("%s.average:%d|ms%s", sr.prefix, stats.Average, tag),
+		fmt.Sprintf("%s.p95:%d|g%s", sr.prefix, stats.P95, tag),
+	}
+	sr.last[tenant] = statsdTotal{total: stats.Total, resets: stats.Resets}
+
+	sr.conn.Write([]byte(strings.Join(lines, "\n")))
+}
+
+//
+// Configuration
+//   - Populated from the command line in main; Validate catches values that flag parsing accepts but
+//     that would only fail later, e.g. when binding the port
+//
+
+type Config struct {
+	Port int
+	PendingStatus int
+	GoneStatus int
+	MinPollInterval time.Duration
+	Rate float64
+	Burst int
+	MaxPasswordBytes int64
+	ThroughputWindow time.Duration
+	CPUBudget time.Duration
+	Algorithm string
+	StatsdAddr string
+	StatsdPrefix string
+	StatsdInterval time.Duration
+	ShutdownMessage string
+	TagKey string
+	UI bool
+	CacheControl string
+	TestMode bool
+	Store string
+	AdminToken string
+	Nap time.Duration
+	EntryTTL time.Duration
+	VerifyOnly bool
+	Workers int
+	RequiredHeader string
+	RequiredHeaderValue string
+	InstanceID string
+	Tenants string
+	PasswordRules PasswordRules
+	KeepAlives bool
+	TCPKeepAlive time.Duration
+	ShutdownTimeout time.Duration
+	ShutdownHook string
+	ShutdownHookTimeout time.Duration
+	TLSCert string
+	TLSKey string
+	LogFormat string
+}
+
+// Returns an error describing the first invalid value
+func (c Config) Validate() error {
+
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d (must be 1-65535)", c.Port)
+	}
+
+	if !validAlgorithm(Algorithm(c.Algorithm)) {
+		return fmt.Errorf("invalid algorithm '%s'", c.Algorithm)
+	}
+
+	if c.MaxPasswordBytes < 1 {
+		return fmt.Errorf("invalid max password bytes %d", c.MaxPasswordBytes)
+	}
+
+	if c.Rate < 0 || (c.Rate > 0 && c.Burst < 1) {
+		return fmt.Errorf("invalid rate %v with burst %d", c.Rate, c.Burst)
+	}
+
+	if c.StatsdAddr != "" && c.StatsdInterval <= 0 { // time.NewTicker panics on it
+		return fmt.Errorf("invalid StatsD interval %v", c.StatsdInterval)
+	}
+
+	if c.ThroughputWindow <= 0 {
+		return fmt.Errorf("invalid throughput window %v", c.ThroughputWindow)
+	}
+
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("invalid log format '%s'", c.LogFormat)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+
+	if (c.RequiredHeader == "") != (c.RequiredHeaderValue == "") {
+		return fmt.Errorf("-required-header and -required-header-value must be set together")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout %v", c.ShutdownTimeout)
+	}
+
+	if c.ShutdownHook != "" {
+		if u, err := url.Parse(c.ShutdownHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid shutdown hook '%s' (http or https URL required)", c.ShutdownHook)
+		}
+		if c.ShutdownHookTimeout <= 0 {
+			return fmt.Errorf("invalid shutdown hook timeout %v", c.ShutdownHookTimeout)
+		}
+	}
+
+	if c.Nap < 0 {
+		return fmt.Errorf("invalid nap %v", c.Nap)
+	}
+
+	if c.EntryTTL < 0 {
+		return fmt.Errorf("invalid entry TTL %v", c.EntryTTL)
+	}
+
+	// tenant names become suffixes of the -store file names
+	if c.Tenants != "" {
+		tenants := make(map[string]bool)
+		for _, tenant := range strings.Split(c.Tenants, ",") {
+			if tenant == "" || strings.ContainsAny(tenant, `/\`) || tenants[tenant] {
+				return fmt.Errorf("invalid tenant '%s'", tenant)
+			}
+			tenants[tenant] = true
+		}
+	}
+
+	// WriteHeader panics on status codes it can't write, and 1xx codes are informational, the real response
+	// would follow; a hash that's gone is always an error
+	if c.PendingStatus < 200 || c.PendingStatus > 599 {
+		return fmt.Errorf("invalid pending status %d (must be 200-599)", c.PendingStatus)
+	}
+	if c.GoneStatus < 400 || c.GoneStatus > 599 {
+		return fmt.Errorf("invalid gone status %d (must be 400-599)", c.GoneStatus)
+	}
+
+	return nil
+}
+
+func validAlgorithm(algo Algorithm) bool {
+	for _, a := range Algorithms {
+		if a == algo {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the routes of the service
+func (pmh PasswordManagerHandler) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/verify", http.HandlerFunc(pmh.verify))
+	mux.Handle("/health", http.HandlerFunc(pmh.health))
+	mux.Handle("/live", http.HandlerFunc(pmh.live))
+	mux.Handle("/ready", http.HandlerFunc(pmh.ready))
+	if pmh.VerifyOnly {
+		return mux
+	}
+
+	mux.Handle("/hash", http.HandlerFunc(pmh.hash))
+	mux.Handle("/hash/", http.HandlerFunc(pmh.hashResource))
+	mux.Handle("/stats", http.HandlerFunc(pmh.stats))
+	mux.Handle("/verify-tag", http.HandlerFunc(pmh.verifyTag))
+	mux.Handle("/ui", http.HandlerFunc(pmh.ui))
+	mux.Handle("/admin/maintenance", http.HandlerFunc(pmh.maintenance))
+	mux.Handle("/admin/stats/reset", http.HandlerFunc(pmh.resetStats))
+	mux.Handle("/admin/budget/reset", http.HandlerFunc(pmh.resetBudget))
+	mux.Handle("/admin/export", http.HandlerFunc(pmh.export))
+	mux.Handle("/admin/import", http.HandlerFunc(pmh.importTasks))
+	if pmh.Metrics != nil {
+		metrics := pmh.Metrics.Handler()
+		mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if pmh.isUnavailable(w) {
+				return
+			}
+			metrics.ServeHTTP(w, req)
+		}))
+	}
+
+	return mux
+}
+
+// Probe endpoints; load balancers and the kubelet call them directly, not through the gateway
+var probePaths = map[string]bool{"/health": true, "/live": true, "/ready": true}
+
+// Wraps the handler so that requests lacking the required header, or carrying another value, get a 401
+//   - blocks clients bypassing a gateway that adds the header with the shared secret; the value is compared in
+//     constant time, like the admin token
+//   - probes don't need the header, otherwise they'd take the instance out of rotation
+func (pmh PasswordManagerHandler) requireHeader(next http.Handler) http.Handler {
+	if pmh.RequiredHeader == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		value := []byte(req.Header.Get(pmh.RequiredHeader))
+		if subtle.ConstantTimeCompare(value, pmh.RequiredHeaderValue) != 1 && !probePaths[req.URL.Path] {
+			pmh.writeError(w, "Missing or invalid header "+pmh.RequiredHeader, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Response writer that remembers the status code for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach the connection's writer, e.g. to flush
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Wraps the handler so that every request is logged
+//   - only the path is logged, never the query or the body, so passwords can't end up in the log
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-ID") // e.g. set by a gateway, ties the lines of both together
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, req)
+		if sr.status == 0 { // nothing written
+			sr.status = http.StatusOK
+		}
+
+		logger.Info("request", "request_id", requestID, "method", req.Method, "path", req.URL.Path,
+			"status", sr.status, "duration_ms", float64(time.Since(start)) / float64(time.Millisecond))
+	})
+}
+
+// Returns a random id for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf("%x", b)
+}
+
+// Returns the logger for the -log-format
+func newLogger(format string, out io.Writer) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(out, nil))
+	}
+
+	return slog.New(slog.NewTextHandler(out, nil))
+}
+
+// Logs the error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Returns the HTTP server for the configuration
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: "localhost:"+strconv.Itoa(cfg.Port), Handler: handler}
+	srv.SetKeepAlivesEnabled(cfg.KeepAlives) // some load balancers balance better with connection churn
+
+	return srv
+}
+
+// Serves HTTPS if a certificate is configured, HTTP otherwise
+func serve(srv *http.Server, ln net.Listener, cfg Config) error {
+	if cfg.TLSCert != "" {
+		return srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	}
+
+	return srv.Serve(ln)
+}
+
+// Returns the listener for the server, with the configured TCP keep-alive period
+func listen(srv *http.Server, cfg Config) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: cfg.TCPKeepAlive} // 0 uses Go's default, negative disables
+
+	return lc.Listen(context.Background(), "tcp", srv.Addr)
+}
+
+func main() {
+	var cfg Config
+	flag.IntVar(&cfg.Port, "port", 8000, "port number")
+	flag.IntVar(&cfg.PendingStatus, "pending-status", http.StatusAccepted, "HTTP status for a hash that is still being calculated (200-599, e.g. 425, or 404 for old clients)")
+	flag.IntVar(&cfg.GoneStatus, "gone-status", http.StatusGone, "HTTP status for a hash that was already retrieved (400-599, e.g. 404 for old clients)")
+	flag.DurationVar(&cfg.MinPollInterval, "min-poll-interval", 0, "minimum time between polls of the same hash by a client (0 disables)")
+	flag.Int64Var(&cfg.MaxPasswordBytes, "max-password-bytes", MaxBodyBytes, "maximum size of POST /hash bodies and passwords; larger ones are rejected with 413")
+	flag.Float64Var(&cfg.Rate, "rate", 0, "POST /hash requests per second per client IP (0 disables)")
+	flag.IntVar(&cfg.Burst, "burst", 10, "POST /hash requests a client IP can send at once with -rate")
+	flag.DurationVar(&cfg.ThroughputWindow, "throughput-window", DefaultThroughputWindow, "rolling window for the throughput in /stats")
+	flag.StringVar(&cfg.Algorithm, "algorithm", string(SHA512), "hash algorithm: sha512, bcrypt (uses the first 72 bytes of a password only), scrypt or argon2id")
+	flag.StringVar(&cfg.Algorithm, "algo", string(SHA512), "short for -algorithm")
+	flag.DurationVar(&cfg.Nap, "nap", NapTimeSec, "simulated processing delay of each hash")
+	flag.DurationVar(&cfg.EntryTTL, "entry-ttl", DefaultEntryTTL, "time after which unretrieved hashes are removed (0 keeps them)")
+	flag.BoolVar(&cfg.VerifyOnly, "verify-only", false, "only serve /verify; no hashes are calculated or stored")
+	flag.IntVar(&cfg.Workers, "workers", DefaultWorkers, "number of hashes calculated concurrently; more are rejected with 429 (0 is unlimited)")
+	flag.DurationVar(&cfg.CPUBudget, "cpu-budget", 0, "total time hashing may take before new hashes are rejected until /admin/budget/reset, which needs -admin-token (0 is unlimited)")
+	flag.StringVar(&cfg.StatsdAddr, "statsd", "", "StatsD host:port to push stats to (empty disables)")
+	flag.StringVar(&cfg.StatsdPrefix, "statsd-prefix", "passwordservice", "prefix for StatsD metric names")
+	flag.DurationVar(&cfg.StatsdInterval, "statsd-interval", 10*time.Second, "time between two StatsD reports")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "how long a shutdown waits for pending hashes before exiting anyway")
+	flag.StringVar(&cfg.ShutdownHook, "shutdown-hook", "", "URL POSTed to when a shutdown begins, e.g. to deregister from service discovery (empty disables)")
+	flag.DurationVar(&cfg.ShutdownHookTimeout, "shutdown-hook-timeout", DefaultShutdownHookTimeout, "how long a shutdown waits for -shutdown-hook")
+	flag.StringVar(&cfg.ShutdownMessage, "shutdown-message", DefaultShutdownMessage, "body of responses rejected during shutdown, e.g. retry guidance")
+	flag.StringVar(&cfg.Store, "store", "", "file that keeps hashes across restarts; tenants use <file>.<tenant> (empty keeps them in memory only)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "bearer token for the /admin endpoints (empty disables them)")
+	flag.StringVar(&cfg.TagKey, "tag-key", "", "key for HMAC tags on retrieved hashes (empty disables)")
+	flag.BoolVar(&cfg.UI, "ui", false, "serve a page for manual hashing on /ui")
+	flag.StringVar(&cfg.CacheControl, "cache-control", DefaultCacheControl, "Cache-Control header for retrieved hashes (empty omits it)")
+	flag.BoolVar(&cfg.TestMode, "test-mode", false, "honor the X-Hash-Delay header to override the processing delay (testing only)")
+	flag.StringVar(&cfg.RequiredHeader, "required-header", "", "reject requests without this header with 401, e.g. X-Gateway-Auth; /health, /live and /ready are exempt (empty disables)")
+	flag.StringVar(&cfg.RequiredHeaderValue, "required-header-value", "", "secret value -required-header must carry; required with it")
+	flag.StringVar(&cfg.InstanceID, "instance-id", "", "instance id reported in /stats (empty uses the hostname)")
+	flag.StringVar(&cfg.Tenants, "tenants", "", "comma separated list of tenants with their own hashes and stats")
+	flag.IntVar(&cfg.PasswordRules.MinLength, "min-password-length", 0, "minimum password length")
+	flag.BoolVar(&cfg.PasswordRules.RequireUpper, "require-upper", false, "require an upper case letter in passwords")
+	flag.BoolVar(&cfg.PasswordRules.RequireLower, "require-lower", false, "require a lower case letter in passwords")
+	flag.BoolVar(&cfg.PasswordRules.RequireDigit, "require-digit", false, "require a digit in passwords")
+	flag.BoolVar(&cfg.PasswordRules.RequireSymbol, "require-symbol", false, "require a symbol in passwords")
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "format of the log on stderr: text or json")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate file; serves HTTPS together with -tls-key (empty serves HTTP)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key file of -tls-cert")
+	flag.BoolVar(&cfg.KeepAlives, "keep-alives", true, "enable HTTP keep-alives")
+	flag.DurationVar(&cfg.TCPKeepAlive, "tcp-keep-alive", 0, "TCP keep-alive period (0 uses the default, negative disables)")
+	flag.Parse()
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	slog.SetDefault(newLogger(cfg.LogFormat, os.Stderr))
+
+	// DI
+	metrics := NewMetrics(prometheus.NewRegistry())
+	newPasswordManager := func(store string) *PasswordManager {
+		pm := NewPasswordManagerWithOptions(DefaultMaxEntries, cfg.Workers, WithNap(cfg.Nap), WithEntryTTL(cfg.EntryTTL),
+			WithMetrics(metrics))
+		pm.ThroughputWindow = cfg.ThroughputWindow
+		pm.CPUBudget = cfg.CPUBudget
+		pm.Algorithm = Algorithm(cfg.Algorithm)
+		if store != "" {
+			fs, err := OpenFileStore(store)
+			if err == nil {
+				err = pm.Restore(fs)
+			}
+			if err != nil {
+				fatal("can't open store", "store", store, "error", err)
+			}
+		}
+		return pm
+	}
+
+	var pm PasswordManagerInterface = newPasswordManager(cfg.Store)
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.NotFoundStatus[TaskPending] = cfg.PendingStatus
+	pmh.NotFoundStatus[TaskGone] = cfg.GoneStatus
+	pmh.PasswordRules = cfg.PasswordRules
+	pmh.Metrics = metrics
+	pmh.MaxPasswordBytes = cfg.MaxPasswordBytes
+	pmh.UI = cfg.UI
+	pmh.TestMode = cfg.TestMode
+	pmh.RequiredHeader = cfg.RequiredHeader
+	pmh.RequiredHeaderValue = []byte(cfg.RequiredHeaderValue)
+	pmh.VerifyOnly = cfg.VerifyOnly
+	if cfg.InstanceID != "" {
+		pmh.InstanceID = cfg.InstanceID
+	}
+	pmh.CacheControl = cfg.CacheControl
+	pmh.ShutdownMessage = cfg.ShutdownMessage
+	pmh.ShutdownTimeout = cfg.ShutdownTimeout
+	if cfg.ShutdownHook != "" {
+		pmh.OnShutdown = shutdownHook(cfg.ShutdownHook, cfg.ShutdownHookTimeout)
+		pmh.ShutdownHookTimeout = cfg.ShutdownHookTimeout
+	}
+	pmh.TagKey = []byte(cfg.TagKey)
+	pmh.AdminToken = []byte(cfg.AdminToken)
+	if cfg.Tenants != "" {
+		pmh.Tenants = make(map[string]PasswordManagerInterface)
+		for _, tenant := range strings.Split(cfg.Tenants, ",") {
+			store := ""
+			if cfg.Store != "" {
+				store = cfg.Store + "." + tenant
+			}
+			pmh.Tenants[tenant] = newPasswordManager(store)
+		}
+	}
+	if cfg.MinPollInterval > 0 {
+		pmh.PollLimiter = NewPollLimiter(cfg.MinPollInterval)
+	}
+	if cfg.Rate > 0 {
+		pmh.RateLimiter = NewRateLimiter(cfg.Rate, cfg.Burst)
+	}
+
+	if cfg.StatsdAddr != "" {
+		sr, err := NewStatsdReporter(pm, cfg.StatsdAddr, cfg.StatsdPrefix, cfg.StatsdInterval)
+		if err != nil {
+			fatal("can't start", "error", err)
+		}
+		sr.Tenants = pmh.Tenants
+		sr.Start()
+	}
+
+	srv := newServer(cfg, accessLog(slog.Default(), pmh.requireHeader(pmh.routes())))
+
+	// Shutdown handler
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-c
+		if err := pmh.shutdownServer(srv); err != nil {
+			slog.Error("server shutdown failed", "error", err)
+		}
+		close(stopped)
+	}()
+
+	ln, err := listen(srv, cfg)
+	if err != nil {
+		fatal("can't listen", "error", err)
+	}
+
+	if err := serve(srv, ln, cfg); err != http.ErrServerClosed {
+		fatal("server failed", "error", err)
+	}
+	<-stopped // Serve returns as soon as the shutdown begins
+}
@@ -1,13 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Super simple unit tests ... just for illustration
 
+// Helper that returns a POST /hash request with a form body
+func newHashRequest(body io.Reader) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/hash", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
 func TestZeroStats(t *testing.T) {
 	var pm PasswordManagerInterface = NewPasswordManager()
 	r, a := pm.Stats()
@@ -16,12 +50,10 @@ func TestZeroStats(t *testing.T) {
 	}
 }
 
-// Verifies hash against expected value
+// Verifies that the hash has the expected format and verifies
 func TestHappyPath(t *testing.T) {
 
-	const expected = "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="
-
-	var pm PasswordManagerInterface = NewPasswordManager()
+	var pm PasswordManagerInterface = NewPasswordManager(WithNap(100*time.Millisecond))
 	id := pm.Hash("angryMonkey")
 	if id != 0 {
 		t.Error("id is not 0")
@@ -34,17 +66,24 @@ func TestHappyPath(t *testing.T) {
 	var pwdHash []byte = nil
 	ts := time.Now()
 	for {
-		pwdHash = pm.Get(id)
+		pwdHash, _ = pm.Get(id)
 		if pwdHash != nil {
-			encoded := base64.StdEncoding.EncodeToString(pwdHash)
-			if encoded != expected {
-				t.Error("hash mismatch")
-			} else {
-				break
+			if pwdHash[0] != VersionSHA512 {
+				t.Errorf("version is %d", pwdHash[0])
 			}
+			if len(pwdHash) != 1+SaltLen+sha512.Size {
+				t.Errorf("hash is %d bytes", len(pwdHash))
+			}
+			if !VerifyPassword("angryMonkey", pwdHash) {
+				t.Error("hash doesn't verify")
+			}
+			if VerifyPassword("angryMonkey2", pwdHash) {
+				t.Error("hash verifies a different password")
+			}
+			break
 		}
 
-		time.Sleep(1*time.Second)
+		time.Sleep(10*time.Millisecond)
 
 		if time.Now().Sub(ts).Seconds() > 10 {
 			t.Error("hash didn't complete in time")
@@ -57,3 +96,3525 @@ func TestHappyPath(t *testing.T) {
 	}
 }
 
+// Verifies that identical passwords get different, salted hashes
+func TestHashIsSalted(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	pm.Hash("angryMonkey")
+	pm.Hash("angryMonkey")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := pm.DrainAll(ctx)
+
+	if bytes.Equal(results[0], results[1]) {
+		t.Error("identical passwords have identical hashes")
+	}
+	if !VerifyPassword("angryMonkey", results[0]) || !VerifyPassword("angryMonkey", results[1]) {
+		t.Error("hashes don't verify")
+	}
+}
+
+
+// Verifies that every algorithm records its version and cost in the hash, and verifies
+func TestAlgorithms(t *testing.T) {
+
+	params := DefaultHashParams
+	params.BcryptCost = 4 // keep the test fast
+	params.ScryptN = 1<<10
+
+	prefixes := map[Algorithm]string{SHA512: "", Bcrypt: "$2a$04$", Scrypt: "$scrypt$ln=10,r=8,p=1$", Argon2id: "$argon2id$"}
+	for _, algo := range Algorithms {
+		sh, err := hashPassword(algo, params, "angryMonkey", newSalt())
+		if err != nil {
+			t.Errorf("%s: %v", algo, err)
+			continue
+		}
+		pwdHash := sh.bytes()
+		if pwdHash[0] != algorithmVersions[algo] {
+			t.Errorf("%s: version is %d", algo, pwdHash[0])
+		}
+		if !strings.HasPrefix(string(pwdHash[1:]), prefixes[algo]) {
+			t.Errorf("%s: hash is '%s'", algo, pwdHash[1:])
+		}
+		if !VerifyPassword("angryMonkey", pwdHash) || VerifyPassword("angryMonkey2", pwdHash) {
+			t.Errorf("%s: hash doesn't verify", algo)
+		}
+	}
+
+	// bcrypt only looks at the first 72 bytes
+	long := strings.Repeat("a", BcryptMaxLen)
+	sh, err := hashPassword(Bcrypt, params, long+"b", newSalt())
+	if err != nil || !VerifyPassword(long+"c", sh.bytes()) {
+		t.Error("bcrypt doesn't truncate long passwords")
+	}
+
+	if _, err := hashPassword("md5", params, "angryMonkey", newSalt()); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+	if VerifyPassword("angryMonkey", nil) || VerifyPassword("angryMonkey", []byte{0x7f}) {
+		t.Error("hash without known version verifies")
+	}
+}
+
+// Verifies that GET /hash/<id> maps each task state to the configured status
+func TestNotFoundStatus(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(100*time.Millisecond))
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.NotFoundStatus[TaskPending] = http.StatusTooEarly
+	pmh.NotFoundStatus[TaskGone] = http.StatusGone
+
+	get := func(id string) int {
+		w := httptest.NewRecorder()
+		pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/"+id, nil))
+		return w.Code
+	}
+
+	id := pm.Hash("angryMonkey")
+	if code := get("0"); code != http.StatusTooEarly {
+		t.Errorf("pending hash returned %d", code)
+	}
+
+	ts := time.Now()
+	for pm.State(id) != TaskReady {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hash didn't complete in time")
+		}
+	}
+
+	if code := get("0"); code != http.StatusOK {
+		t.Errorf("ready hash returned %d", code)
+	}
+	if code := get("0"); code != http.StatusGone {
+		t.Errorf("retrieved hash returned %d", code)
+	}
+	if code := get("42"); code != http.StatusNotFound {
+		t.Errorf("unknown hash returned %d", code)
+	}
+}
+
+// Verifies that a clock going backward doesn't add a negative processing time
+func TestClockGoesBackward(t *testing.T) {
+
+	pm := NewPasswordManager()
+	ts := time.Now()
+	pm.now = func() time.Time { return ts.Add(-1*time.Hour) } // clock was set back while hashing
+
+	pm.pendingHashes++
+	pm.storeHash(0, storedHash{hash: []byte("hash")}, ts)
+
+	r, a := pm.Stats()
+	if r != 1 {
+		t.Error("request wasn't counted")
+	}
+	if a != 0 {
+		t.Errorf("average is %d", a)
+	}
+}
+
+// Verifies that maintenance mode rejects API requests until it's turned off again
+func TestMaintenanceMode(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.AdminToken = []byte("secret")
+
+	setMaintenanceAs := func(token string, enabled string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader("enabled="+enabled))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		pmh.maintenance(w, req)
+		return w.Code
+	}
+	setMaintenance := func(enabled string) int {
+		return setMaintenanceAs("secret", enabled)
+	}
+
+	if code := setMaintenanceAs("", "true"); code != http.StatusUnauthorized {
+		t.Errorf("enabling maintenance without token returned %d", code)
+	}
+	if code := setMaintenanceAs("wrong", "true"); code != http.StatusUnauthorized {
+		t.Errorf("enabling maintenance with wrong token returned %d", code)
+	}
+	if pmh.PasswordManager.IsInMaintenance() {
+		t.Fatal("maintenance enabled without token")
+	}
+	stats := func() int {
+		w := httptest.NewRecorder()
+		pmh.stats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		return w.Code
+	}
+
+	if code := setMaintenance("true"); code != http.StatusOK {
+		t.Fatalf("enabling maintenance returned %d", code)
+	}
+	if code := stats(); code != http.StatusServiceUnavailable {
+		t.Errorf("stats during maintenance returned %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	pmh.hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("hash during maintenance returned %d", w.Code)
+	}
+	if pmh.PasswordManager.HasPendingHashes() {
+		t.Error("hash was started during maintenance")
+	}
+
+	pmh.TagKey = []byte("secret")
+	pmh.Metrics = NewMetrics(prometheus.NewRegistry())
+	mux := pmh.routes()
+	for _, ep := range []struct {
+		method string
+		path string
+	}{
+		{http.MethodPost, "/verify"},
+		{http.MethodPost, "/verify-tag"},
+		{http.MethodGet, "/metrics"},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(ep.method, ep.path, strings.NewReader("{}")))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s during maintenance returned %d", ep.path, w.Code)
+		}
+	}
+
+	if code := setMaintenance("false"); code != http.StatusOK {
+		t.Fatalf("disabling maintenance returned %d", code)
+	}
+	if code := stats(); code != http.StatusOK {
+		t.Errorf("stats after maintenance returned %d", code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("metrics after maintenance returned %d", w.Code)
+	}
+	if pmh.PasswordManager.IsShuttingDown() {
+		t.Error("maintenance mode initiated a shutdown")
+	}
+}
+
+// Verifies that polling the same id too fast is rejected with a Retry-After
+func TestPollLimiter(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.PollLimiter = NewPollLimiter(1*time.Minute)
+
+	get := func(id string, client string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/hash/"+id, nil)
+		req.RemoteAddr = client
+		pmh.get(w, req)
+		return w
+	}
+
+	if w := get("1", "10.0.0.1:1234"); w.Code != http.StatusNotFound {
+		t.Errorf("first poll returned %d", w.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		w := get("1", "10.0.0.1:5678") // same client, different port
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("rapid poll returned %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") != "60" {
+			t.Errorf("unexpected Retry-After '%s'", w.Header().Get("Retry-After"))
+		}
+	}
+
+	if w := get("2", "10.0.0.1:1234"); w.Code != http.StatusNotFound {
+		t.Errorf("poll of another id returned %d", w.Code)
+	}
+	if w := get("1", "10.0.0.2:1234"); w.Code != http.StatusNotFound {
+		t.Errorf("poll by another client returned %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hash/1", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	pmh.Tenants = map[string]PasswordManagerInterface{"acme": NewPasswordManager()}
+	pmh.get(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("poll of the same id of another tenant returned %d", w.Code)
+	}
+}
+
+// Verifies that the rate limiter allows a burst and then the rate, per client
+func TestRateLimiter(t *testing.T) {
+
+	rl := NewRateLimiter(2, 3)
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if wait := rl.Allow("10.0.0.1"); wait != 0 {
+			t.Fatalf("request %d of the burst had to wait %v", i, wait)
+		}
+	}
+	if wait := rl.Allow("10.0.0.1"); wait != 500*time.Millisecond {
+		t.Errorf("request after the burst had to wait %v", wait)
+	}
+	if wait := rl.Allow("10.0.0.2"); wait != 0 {
+		t.Errorf("other client had to wait %v", wait)
+	}
+
+	now = now.Add(500*time.Millisecond)
+	if wait := rl.Allow("10.0.0.1"); wait != 0 {
+		t.Errorf("request after the refill had to wait %v", wait)
+	}
+
+	// full buckets are swept
+	now = now.Add(1*time.Hour)
+	rl.Allow("10.0.0.3")
+	if n := len(rl.buckets); n != 1 {
+		t.Errorf("%d buckets after the sweep", n)
+	}
+}
+
+// Verifies that concurrent requests can't take more tokens than the burst
+func TestRateLimiterConcurrent(t *testing.T) {
+
+	rl := NewRateLimiter(1, 10)
+	now := time.Now()
+	rl.now = func() time.Time { return now } // no refill
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rl.Allow("10.0.0.1") == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("%d requests allowed", allowed)
+	}
+}
+
+// Verifies that POST /hash rejects clients over the rate with a Retry-After
+func TestHashRateLimit(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+	pmh.RateLimiter = NewRateLimiter(0.5, 1)
+
+	post := func(client string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := newHashRequest(strings.NewReader("password=angryMonkey"))
+		req.RemoteAddr = client
+		pmh.hash(w, req)
+		return w
+	}
+
+	if w := post("10.0.0.1:1234"); w.Code != http.StatusAccepted {
+		t.Errorf("first request returned %d", w.Code)
+	}
+	w := post("10.0.0.1:5678") // same client, different port
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("request over the rate returned %d, Retry-After '%s'", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := post("10.0.0.2:1234"); w.Code != http.StatusAccepted {
+		t.Errorf("other client returned %d", w.Code)
+	}
+}
+
+// Verifies that completed hashes are counted until they are retrieved
+func TestUnretrievedCount(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	for i := 0; i < 3; i++ {
+		pm.Hash("angryMonkey")
+	}
+
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+
+	if n := pm.UnretrievedCount(); n != 3 {
+		t.Errorf("unretrieved count is %d", n)
+	}
+
+	pm.Get(0)
+
+	w := httptest.NewRecorder()
+	NewPasswordManagerHandler(pm).stats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(w.Body.String(), "\"unretrieved\": 2") {
+		t.Errorf("unexpected stats '%s'", w.Body.String())
+	}
+}
+
+// ResponseWriter that throws everything away ... keeps the recorder's allocations out of the benchmarks
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// Concurrent hash encoding with pooled buffers
+func BenchmarkWriteHash(b *testing.B) {
+	pwdHash := make([]byte, 64)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardResponseWriter{header: make(http.Header)}
+		for pb.Next() {
+			writeHash(w, pwdHash)
+		}
+	})
+}
+
+// Same as above with a fresh buffer per fetch, for comparison
+func BenchmarkWriteHashUnpooled(b *testing.B) {
+	pwdHash := make([]byte, 64)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardResponseWriter{header: make(http.Header)}
+		for pb.Next() {
+			encoded := make([]byte, base64.StdEncoding.EncodedLen(len(pwdHash)))
+			base64.StdEncoding.Encode(encoded, pwdHash)
+			w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+			w.Write(encoded)
+		}
+	})
+}
+
+// Verifies that the Content-Type selects the body format and that form passwords are URL decoded
+func TestParsePasswordContentType(t *testing.T) {
+
+	const form = "application/x-www-form-urlencoded"
+	tests := []struct {
+		contentType, body, expected string
+	}{
+		{form, "password=a=b=c", "a=b=c"},
+		{form, "password=a%26b%3Dc", "a&b=c"},
+		{form, "password=angry%20Monkey&remember=true", "angry Monkey"},
+		{form, "password=YW5ncnlNb25rZXk=", "YW5ncnlNb25rZXk="},
+		{"application/json", "{\"password\": \"a=b&c\"}", "a=b&c"},
+		{"application/json; charset=utf-8", "{\"password\": \"angryMonkey\"}", "angryMonkey"},
+	}
+	for _, test := range tests {
+		if pwd, err := parsePassword(test.contentType, []byte(test.body)); err != nil || pwd != test.expected {
+			t.Errorf("'%s' (%s) parsed as '%s': %v", test.body, test.contentType, pwd, err)
+		}
+	}
+
+	for _, body := range []string{"password=&remember=true", "remember=true", "password=%zz"} {
+		if _, err := parsePassword(form, []byte(body)); err != errInvalidParameters {
+			t.Errorf("'%s' returned %v", body, err)
+		}
+	}
+	for _, body := range []string{"password=angryMonkey", "{\"password\": \"\"}", "{\"pwd\": \"angryMonkey\"}"} {
+		if _, err := parsePassword("application/json", []byte(body)); err != errInvalidParameters {
+			t.Errorf("JSON '%s' returned %v", body, err)
+		}
+	}
+}
+
+// Verifies that POST /hash answers with the id as JSON and where to poll for the hash
+func TestHashResponse(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	pmh := NewPasswordManagerHandler(pm)
+	pm.Hash("angryMonkey")
+
+	w := httptest.NewRecorder()
+	pmh.hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d", w.Code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type '%s'", ct)
+	}
+	var res HashResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.ID != 1 {
+		t.Errorf("unexpected body '%s'", w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); loc != "/hash/1" {
+		t.Errorf("unexpected Location '%s'", loc)
+	}
+}
+
+// Verifies that POST /hash answers the bare id to clients that accept text/plain and JSON otherwise
+func TestHashAccept(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+
+	for _, test := range []struct {
+		accept, contentType, body string
+	}{
+		{"", "application/json", "{\"id\":0}"},
+		{"application/json", "application/json", "{\"id\":1}"},
+		{"text/plain", "text/plain; charset=UTF-8", "2"},
+		{"text/plain;q=0.9, application/json", "text/plain; charset=UTF-8", "3"},
+		{"application/json, text/plain", "application/json", "{\"id\":4}"},
+		{"*/*", "application/json", "{\"id\":5}"},
+	} {
+		w := httptest.NewRecorder()
+		req := newHashRequest(strings.NewReader("password=angryMonkey"))
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		pmh.hash(w, req)
+
+		if w.Code != http.StatusAccepted || w.Header().Get("Content-Type") != test.contentType || w.Body.String() != test.body {
+			t.Errorf("Accept '%s' returned %d '%s' '%s'", test.accept, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+}
+
+// Verifies that a retry with the same Idempotency-Key gets the original id until the hash is retrieved
+func TestIdempotencyKey(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	pmh := NewPasswordManagerHandler(pm)
+
+	post := func(key string) (int, int64) {
+		w := httptest.NewRecorder()
+		req := newHashRequest(strings.NewReader("password=angryMonkey"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		pmh.hash(w, req)
+		var res HashResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.ID
+	}
+
+	if code, id := post("retry-1"); code != http.StatusAccepted || id != 0 {
+		t.Fatalf("first request returned %d, id %d", code, id)
+	}
+	if code, id := post("retry-1"); code != http.StatusOK || id != 0 {
+		t.Errorf("repeat while pending returned %d, id %d", code, id)
+	}
+	if code, id := post("retry-2"); code != http.StatusAccepted || id != 1 {
+		t.Errorf("other key returned %d, id %d", code, id)
+	}
+	if code, id := post(""); code != http.StatusAccepted || id != 2 {
+		t.Errorf("no key returned %d, id %d", code, id)
+	}
+
+	<-waitIdle(pm)
+	if code, id := post("retry-1"); code != http.StatusOK || id != 0 {
+		t.Errorf("repeat while ready returned %d, id %d", code, id)
+	}
+
+	// once the hash is retrieved the key is forgotten
+	pm.Get(0)
+	if code, id := post("retry-1"); code != http.StatusAccepted || id != 3 {
+		t.Errorf("repeat after retrieval returned %d, id %d", code, id)
+	}
+
+	pm.Get(1)
+	pm.Lock()
+	pm.expireKeys()
+	_, ok := pm.keys["retry-2"]
+	pm.Unlock()
+	if ok {
+		t.Error("key of a retrieved hash wasn't expired")
+	}
+
+	if code, _ := post(strings.Repeat("k", MaxIdempotencyKeyBytes+1)); code != http.StatusBadRequest {
+		t.Errorf("long key returned %d", code)
+	}
+}
+
+// Verifies that POST /hash accepts both content types and rejects others with 415
+func TestHashContentType(t *testing.T) {
+
+	post := func(contentType string, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hash", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		NewPasswordManagerHandler(NewPasswordManager()).hash(w, req)
+		return w.Code
+	}
+
+	if code := post("application/x-www-form-urlencoded", "password=a=b=c"); code != http.StatusAccepted {
+		t.Errorf("form body returned %d", code)
+	}
+	if code := post("application/json", "{\"password\": \"angryMonkey\"}"); code != http.StatusAccepted {
+		t.Errorf("JSON body returned %d", code)
+	}
+	if code := post("", "password=angryMonkey"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("body without content type returned %d", code)
+	}
+	if code := post("text/plain", "angryMonkey"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("text body returned %d", code)
+	}
+}
+
+// Verifies that oversized bodies are rejected before parsing
+func TestBodyTooLarge(t *testing.T) {
+
+	for _, size := range []int{MaxBodyBytes+1, 5000} {
+		w := httptest.NewRecorder()
+		body := "password=" + strings.Repeat("a", size-len("password="))
+		NewPasswordManagerHandler(NewPasswordManager()).hash(w, newHashRequest(strings.NewReader(body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%d byte body returned %d", size, w.Code)
+		}
+	}
+}
+
+// Verifies that bodies are rejected right above the configured maximum
+func TestMaxPasswordBytes(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+	pmh.MaxPasswordBytes = 100
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		pmh.hash(w, newHashRequest(strings.NewReader(body)))
+		return w.Code
+	}
+
+	field := "password="
+	if code := post(field + strings.Repeat("a", 100-len(field))); code != http.StatusAccepted {
+		t.Errorf("body at the limit returned %d", code)
+	}
+	if code := post(field + strings.Repeat("a", 101-len(field))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body above the limit returned %d", code)
+	}
+	if code := post(field); code != http.StatusBadRequest {
+		t.Errorf("empty password returned %d", code)
+	}
+
+	// the verify endpoints allow for the hash, tag or id besides the password
+	pmh.TagKey = []byte("secret")
+	mux := pmh.routes()
+	for _, path := range []string{"/verify", "/verify-tag", "/hash/verify"} {
+		w := httptest.NewRecorder()
+		body := "{\"password\": \"" + strings.Repeat("a", 100+VerifyBodyOverhead) + "\"}"
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("body above the limit of %s returned %d", path, w.Code)
+		}
+	}
+	for _, path := range []string{"/verify", "/hash/verify"} {
+		w := httptest.NewRecorder()
+		body := "{\"id\": 1, \"password\": \"" + strings.Repeat("a", 101) + "\", \"hash\": \"YQ==\"}"
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("password above the limit of %s returned %d", path, w.Code)
+		}
+	}
+}
+
+// Verifies the metrics sent to StatsD
+func TestStatsdReporter(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	pm := NewPasswordManager()
+	pm.Hash("angryMonkey")
+
+	sr, err := NewStatsdReporter(pm, listener.LocalAddr().String(), "pws", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.Start()
+	defer sr.Stop()
+
+	buf := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(5*time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := string(buf[:n])
+	for _, metric := range []string{"pws.hashes:0|c", "pws.total:0|g", "pws.pending:1|g", "pws.average:0|ms", "pws.p95:0|g"} {
+		if !strings.Contains(packet, metric) {
+			t.Errorf("'%s' missing in '%s'", metric, packet)
+		}
+	}
+}
+
+// Verifies that the StatsD counter restarts after the stats were reset, and that tenants are reported too
+func TestStatsdReporterReset(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	pm := NewPasswordManager()
+	for i := int64(0); i < 3; i++ {
+		pm.pendingHashes++
+		pm.storeHash(i, storedHash{hash: []byte("hash")}, time.Now())
+	}
+
+	sr, err := NewStatsdReporter(pm, listener.LocalAddr().String(), "pws", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Stop()
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(5*time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	sr.report()
+	if packet := read(); !strings.Contains(packet, "pws.hashes:3|c") {
+		t.Errorf("'%s' before the reset", packet)
+	}
+
+	// as many hashes after the reset as before, so the total alone doesn't tell
+	pm.ResetStats()
+	for i := int64(3); i < 7; i++ {
+		pm.pendingHashes++
+		pm.storeHash(i, storedHash{hash: []byte("hash")}, time.Now())
+	}
+	sr.report()
+	if packet := read(); !strings.Contains(packet, "pws.hashes:4|c") {
+		t.Errorf("'%s' after the reset", packet)
+	}
+
+	tenant := NewPasswordManager()
+	tenant.pendingHashes++
+	tenant.storeHash(0, storedHash{hash: []byte("hash")}, time.Now())
+	sr.Tenants = map[string]PasswordManagerInterface{"acme": tenant}
+	sr.report()
+	if packet := read(); !strings.Contains(packet, "pws.hashes:0|c\n") {
+		t.Errorf("'%s' for the default manager", packet)
+	}
+	if packet := read(); !strings.Contains(packet, "pws.hashes:1|c|#tenant:acme") {
+		t.Errorf("'%s' for the tenant", packet)
+	}
+}
+
+// Verifies the password complexity rules
+func TestPasswordRules(t *testing.T) {
+
+	rules := PasswordRules{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+
+	if rule := rules.Check("angryMonkey1!"); rule != "" {
+		t.Errorf("compliant password rejected: %s", rule)
+	}
+
+	weak := map[string]string{
+		"aM1!":          "must be at least 8 characters",
+		"angrymonkey1!": "must contain an upper case letter",
+		"ANGRYMONKEY1!": "must contain a lower case letter",
+		"angryMonkey!":  "must contain a digit",
+		"angryMonkey1":  "must contain a symbol",
+	}
+	for pwd, expected := range weak {
+		if rule := rules.Check(pwd); rule != expected {
+			t.Errorf("'%s' failed with '%s'", pwd, rule)
+		}
+	}
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.PasswordRules = rules
+	w := httptest.NewRecorder()
+	pmh.hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("weak password returned %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "must contain a digit") {
+		t.Errorf("unexpected body '%s'", w.Body.String())
+	}
+}
+
+// Verifies that a hash is counted in the stats window in which it completes
+func TestResetStatsAttribution(t *testing.T) {
+
+	pm := NewPasswordManager()
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+
+	// completes before the reset
+	pm.pendingHashes++
+	pm.storeHash(0, storedHash{hash: []byte("hash")}, now.Add(-1*time.Second))
+
+	// starts before the reset, completes after it
+	started := now
+	now = now.Add(2*time.Second)
+	pm.pendingHashes++
+
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.AdminToken = []byte("secret")
+
+	w := httptest.NewRecorder()
+	pmh.resetStats(w, httptest.NewRequest(http.MethodPost, "/admin/stats/reset", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reset without token returned %d", w.Code)
+	}
+	if r, _ := pm.Stats(); r != 1 {
+		t.Fatalf("reset without token cleared the stats")
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/stats/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	pmh.resetStats(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("reset returned %d", w.Code)
+	}
+	if r, a := pm.Stats(); r != 0 || a != 0 {
+		t.Errorf("stats after reset are %d/%d", r, a)
+	}
+
+	now = now.Add(3*time.Second)
+	pm.storeHash(1, storedHash{hash: []byte("hash")}, started)
+
+	if r, a := pm.Stats(); r != 1 || a != 5000 {
+		t.Errorf("stats after straddling hash are %d/%d", r, a)
+	}
+}
+
+// Verifies that tenants get their own ids and can only retrieve their own hashes
+func TestTenants(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.Tenants = map[string]PasswordManagerInterface{"a": NewPasswordManager(WithNap(0)), "b": NewPasswordManager(WithNap(0))}
+
+	request := func(method string, path string, body string, tenant string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Tenant", tenant)
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			pmh.hash(w, req)
+		} else {
+			pmh.get(w, req)
+		}
+		return w
+	}
+
+	for _, tenant := range []string{"a", "b"} {
+		var res HashResponse
+		w := request(http.MethodPost, "/hash", "password=angryMonkey", tenant)
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.ID != 0 {
+			t.Errorf("tenant %s got '%s'", tenant, w.Body.String())
+		}
+	}
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey", "c"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown tenant returned %d", w.Code)
+	}
+	if pmh.PasswordManager.HasPendingHashes() {
+		t.Error("tenant hash went to the default manager")
+	}
+
+	ts := time.Now()
+	for pmh.Tenants["a"].HasPendingHashes() || pmh.Tenants["b"].HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+
+	if w := request(http.MethodGet, "/hash/0", "", "a"); w.Code != http.StatusOK {
+		t.Errorf("tenant a couldn't retrieve its hash: %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/hash/0", "", "b"); w.Code != http.StatusOK {
+		t.Errorf("retrieval by tenant a consumed tenant b's hash: %d", w.Code)
+	}
+}
+
+// Verifies that the manual hashing page is only served when enabled
+func TestUI(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+
+	w := httptest.NewRecorder()
+	pmh.ui(w, httptest.NewRequest(http.MethodGet, "/ui", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("disabled ui returned %d", w.Code)
+	}
+
+	pmh.UI = true
+	w = httptest.NewRecorder()
+	pmh.ui(w, httptest.NewRequest(http.MethodGet, "/ui", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("enabled ui returned %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "<form") {
+		t.Error("ui isn't an HTML form")
+	}
+}
+
+// Verifies that requests rejected during shutdown carry the configured message
+func TestShutdownMessage(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.ShutdownMessage = "Down for an upgrade - retry in 5 minutes or contact ops@example.com"
+	pmh.PasswordManager.Shutdown()
+
+	w := httptest.NewRecorder()
+	pmh.stats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if res := decodeError(t, w); res.Error != pmh.ShutdownMessage {
+		t.Errorf("unexpected body '%s'", w.Body.String())
+	}
+}
+
+// Verifies that the endpoints answer 503 with a Retry-After during shutdown
+func TestShutdownUnavailable(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.AdminToken = []byte("secret")
+	pmh.PasswordManager.Shutdown()
+	mux := pmh.routes()
+
+	for _, ep := range []struct {
+		method, path, contentType, body string
+	}{
+		{http.MethodPost, "/hash", "application/x-www-form-urlencoded", "password=angryMonkey"},
+		{http.MethodGet, "/hash/0", "", ""},
+		{http.MethodGet, "/stats", "", ""},
+		{http.MethodPost, "/admin/maintenance", "application/x-www-form-urlencoded", "enabled=true"},
+		{http.MethodPost, "/admin/stats/reset", "", ""},
+		{http.MethodPost, "/admin/budget/reset", "", ""},
+		{http.MethodPost, "/admin/import", "application/json", "{\"next_id\": 0}"},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(ep.method, ep.path, strings.NewReader(ep.body))
+		if ep.contentType != "" {
+			req.Header.Set("Content-Type", ep.contentType)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+			t.Errorf("%s %s returned %d, Retry-After '%s'", ep.method, ep.path, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// Helper that decodes a JSON error response
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) ErrorResponse {
+	t.Helper()
+
+	var res ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("error body '%s' isn't JSON: %v", w.Body.String(), err)
+	}
+	if res.Code != w.Code {
+		t.Errorf("error body has code %d, response %d", res.Code, w.Code)
+	}
+
+	return res
+}
+
+// Verifies that errors are returned as JSON
+func TestErrorResponse(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+
+	w := httptest.NewRecorder()
+	pmh.hash(w, newHashRequest(strings.NewReader("pwd=angryMonkey")))
+	if w.Code != http.StatusBadRequest || decodeError(t, w).Error != "Invalid parameters" {
+		t.Errorf("invalid parameters returned %d '%s'", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("unexpected Content-Type '%s'", ct)
+	}
+
+	w = httptest.NewRecorder()
+	pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/42", nil))
+	if w.Code != http.StatusNotFound || decodeError(t, w).Error != "Hash not found" {
+		t.Errorf("unknown hash returned %d '%s'", w.Code, w.Body.String())
+	}
+
+	pmh.TagKey = []byte("secret")
+	pmh.AdminToken = []byte("secret")
+	pmh.UI = true
+	pmh.RequiredHeader = "X-Gateway-Auth"
+	pmh.RequiredHeaderValue = []byte("gateway")
+	handler := pmh.requireHeader(pmh.routes())
+	for _, ep := range []struct {
+		method, path, token string
+		code int
+	}{
+		{http.MethodGet, "/verify", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/verify", "", http.StatusBadRequest},
+		{http.MethodPost, "/verify-tag", "", http.StatusBadRequest},
+		{http.MethodPost, "/ui", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/export", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/import", "secret", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(ep.method, ep.path, strings.NewReader("{}"))
+		req.Header.Set("X-Gateway-Auth", "gateway")
+		req.Header.Set("Authorization", "Bearer "+ep.token)
+		handler.ServeHTTP(w, req)
+		if w.Code != ep.code {
+			t.Errorf("%s %s returned %d", ep.method, ep.path, w.Code)
+		}
+		decodeError(t, w)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without the required header returned %d", w.Code)
+	}
+	decodeError(t, w)
+}
+
+// Verifies that the integrity tag of a retrieved hash only verifies for the unmodified hash
+func TestHashTag(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.TagKey = []byte("secret")
+
+	pm.Lock()
+	pm.tasks[0] = storedHash{hash: []byte("some digest")}
+	pm.id = 1
+	pm.Unlock()
+
+	w := httptest.NewRecorder()
+	pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/0", nil))
+	hash, tag := w.Body.String(), w.Header().Get("X-Hash-Tag")
+	if tag == "" {
+		t.Fatal("no tag")
+	}
+
+	verify := func(hash string) string {
+		w := httptest.NewRecorder()
+		body := "{\"hash\": \"" + hash + "\", \"tag\": \"" + tag + "\"}"
+		pmh.verifyTag(w, httptest.NewRequest(http.MethodPost, "/verify-tag", strings.NewReader(body)))
+		return w.Body.String()
+	}
+
+	if body := verify(hash); body != "{\"valid\": true}" {
+		t.Errorf("valid tag returned '%s'", body)
+	}
+
+	modified := base64.StdEncoding.EncodeToString([]byte("some digesT"))
+	if body := verify(modified); body != "{\"valid\": false}" {
+		t.Errorf("modified hash returned '%s'", body)
+	}
+}
+
+// Verifies that out of range ports are rejected
+func TestConfigValidatePort(t *testing.T) {
+
+	cfg := Config{PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, port := range []int{0, -1, 70000} {
+		cfg.Port = port
+		if cfg.Validate() == nil {
+			t.Errorf("port %d was accepted", port)
+		}
+	}
+
+	for _, port := range []int{1, 8000, 65535} {
+		cfg.Port = port
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("port %d was rejected: %v", port, err)
+		}
+	}
+}
+
+// Verifies that the pending status must be a final status and the gone status an error
+func TestConfigValidateStatus(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, status := range []int{0, 99, 100, 103, 199, 600} {
+		cfg.PendingStatus = status
+		if cfg.Validate() == nil {
+			t.Errorf("pending status %d was accepted", status)
+		}
+	}
+	for _, status := range []int{200, 202, 404, 425, 599} {
+		cfg.PendingStatus = status
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("pending status %d was rejected: %v", status, err)
+		}
+	}
+
+	cfg.PendingStatus = http.StatusAccepted
+	for _, status := range []int{0, 100, 101, 200, 204, 301, 399, 600} {
+		cfg.GoneStatus = status
+		if cfg.Validate() == nil {
+			t.Errorf("gone status %d was accepted", status)
+		}
+	}
+	for _, status := range []int{400, 404, 410, 599} {
+		cfg.GoneStatus = status
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("gone status %d was rejected: %v", status, err)
+		}
+	}
+}
+
+// Verifies that StatsD needs a positive interval
+func TestConfigValidateStatsdInterval(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	if err := cfg.Validate(); err != nil { // unused without -statsd
+		t.Errorf("zero interval without StatsD was rejected: %v", err)
+	}
+
+	cfg.StatsdAddr = "localhost:8125"
+	for _, interval := range []time.Duration{0, -1*time.Second} {
+		cfg.StatsdInterval = interval
+		if cfg.Validate() == nil {
+			t.Errorf("interval %v was accepted", interval)
+		}
+	}
+
+	cfg.StatsdInterval = 10*time.Second
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("interval 10s was rejected: %v", err)
+	}
+}
+
+// Verifies that the TLS files are only accepted together
+func TestConfigValidateTLS(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, files := range [][2]string{{"cert.pem", ""}, {"", "key.pem"}} {
+		cfg.TLSCert, cfg.TLSKey = files[0], files[1]
+		if cfg.Validate() == nil {
+			t.Errorf("cert '%s' and key '%s' were accepted", files[0], files[1])
+		}
+	}
+
+	cfg.TLSCert, cfg.TLSKey = "cert.pem", "key.pem"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("cert and key were rejected: %v", err)
+	}
+}
+
+// Verifies that tenant names can be used as -store suffixes
+func TestConfigValidateTenants(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, tenants := range []string{",acme", "acme,", "acme,,globex", "../acme", "acme/x", `acme\x`, "acme,acme"} {
+		cfg.Tenants = tenants
+		if cfg.Validate() == nil {
+			t.Errorf("tenants '%s' were accepted", tenants)
+		}
+	}
+
+	for _, tenants := range []string{"", "acme", "acme,globex"} {
+		cfg.Tenants = tenants
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("tenants '%s' were rejected: %v", tenants, err)
+		}
+	}
+}
+
+// Verifies that the shutdown hook needs an HTTP URL and a positive timeout
+func TestConfigValidateShutdownHook(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, hook := range []string{"deregister.sh", "ftp://registry/deregister", "http://", ":"} {
+		cfg.ShutdownHook, cfg.ShutdownHookTimeout = hook, time.Second
+		if cfg.Validate() == nil {
+			t.Errorf("hook '%s' was accepted", hook)
+		}
+	}
+
+	cfg.ShutdownHook, cfg.ShutdownHookTimeout = "http://registry/deregister", 0
+	if cfg.Validate() == nil {
+		t.Error("hook timeout 0 was accepted")
+	}
+
+	cfg.ShutdownHookTimeout = time.Second
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("hook was rejected: %v", err)
+	}
+}
+
+// Verifies that the required header is only accepted with its value
+func TestConfigValidateRequiredHeader(t *testing.T) {
+
+	cfg := Config{Port: 8000, PendingStatus: http.StatusNotFound, GoneStatus: http.StatusNotFound, ThroughputWindow: DefaultThroughputWindow, Algorithm: string(SHA512), LogFormat: "json", MaxPasswordBytes: MaxBodyBytes}
+
+	for _, header := range [][2]string{{"X-Gateway-Auth", ""}, {"", "secret"}} {
+		cfg.RequiredHeader, cfg.RequiredHeaderValue = header[0], header[1]
+		if cfg.Validate() == nil {
+			t.Errorf("header '%s' with value '%s' was accepted", header[0], header[1])
+		}
+	}
+
+	cfg.RequiredHeader, cfg.RequiredHeaderValue = "X-Gateway-Auth", "secret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("header with value was rejected: %v", err)
+	}
+}
+
+// Helper that writes a self-signed certificate for 127.0.0.1 and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile string, keyFile string, cert *x509.Certificate) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-1*time.Hour),
+		NotAfter:     time.Now().Add(1*time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+// Verifies a hash round trip over HTTPS
+func TestServeTLS(t *testing.T) {
+
+	var cfg Config
+	var cert *x509.Certificate
+	cfg.TLSCert, cfg.TLSKey, cert = writeTestCert(t, t.TempDir())
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+	srv := &http.Server{Handler: pmh.routes()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(srv, ln, cfg)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	url := "https://" + ln.Addr().String()
+
+	res, err := client.Post(url+"/hash", "application/x-www-form-urlencoded", strings.NewReader("password=angryMonkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST returned %d", res.StatusCode)
+	}
+
+	location := res.Header.Get("Location")
+	ts := time.Now()
+	for {
+		res, err = client.Get(url + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Since(ts) > 5*time.Second {
+			t.Fatalf("GET returned %d", res.StatusCode)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+// Verifies that the access log records the status and never the body
+func TestAccessLog(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+	var out bytes.Buffer
+	handler := accessLog(newLogger("json", &out), pmh.routes())
+
+	req := httptest.NewRequest(http.MethodGet, "/hash/999", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var entry struct {
+		RequestID string `json:"request_id"`
+		Method string `json:"method"`
+		Path string `json:"path"`
+		Status int `json:"status"`
+		DurationMs *float64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log line '%s' isn't JSON: %v", out.String(), err)
+	}
+	if entry.RequestID != "req-1" || entry.Method != http.MethodGet || entry.Path != "/hash/999" ||
+		entry.Status != http.StatusNotFound || entry.DurationMs == nil {
+		t.Errorf("unexpected log line '%s'", out.String())
+	}
+
+	out.Reset()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if strings.Contains(out.String(), "angryMonkey") {
+		t.Errorf("password in log line '%s'", out.String())
+	}
+	if !strings.Contains(out.String(), "\"status\":202") {
+		t.Errorf("unexpected log line '%s'", out.String())
+	}
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("no request id generated")
+	}
+}
+
+// Verifies that a failed hash is logged with its id
+func TestLogHashID(t *testing.T) {
+
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger("json", &out))
+
+	pm := NewPasswordManager(WithNap(0))
+	pm.hasher = func(Algorithm, HashParams, string, []byte) (storedHash, error) {
+		return storedHash{}, errors.New("broken")
+	}
+	id := pm.Hash("angryMonkey")
+	<-waitIdle(pm)
+
+	var entry struct {
+		Level string `json:"level"`
+		HashID *int64 `json:"hash_id"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log line '%s' isn't JSON: %v", out.String(), err)
+	}
+	if entry.Level != "ERROR" || entry.HashID == nil || *entry.HashID != id || entry.Error != "broken" {
+		t.Errorf("unexpected log line '%s'", out.String())
+	}
+}
+
+// Verifies the latency distribution for known durations
+func TestStatsDetailed(t *testing.T) {
+
+	pm := NewPasswordManager()
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+
+	// 1ms to 100ms, in reverse so that the order doesn't matter
+	for i := 100; i >= 1; i-- {
+		pm.pendingHashes++
+		pm.storeHash(int64(i), storedHash{hash: []byte("hash")}, now.Add(-time.Duration(i)*time.Millisecond))
+	}
+	pm.pendingHashes++
+
+	stats := pm.StatsDetailed()
+	expected := DetailedStats{Total: 100, Average: 50, Pending: 1, Min: 1, Max: 100, P50: 50, P95: 95}
+	if stats != expected {
+		t.Errorf("got %+v, expected %+v", stats, expected)
+	}
+
+	// the percentiles only cover the latest samples
+	for i := 0; i < MaxDurationSamples; i++ {
+		pm.pendingHashes++
+		pm.storeHash(int64(1000+i), storedHash{hash: []byte("hash")}, now.Add(-200*time.Millisecond))
+	}
+	if stats := pm.StatsDetailed(); stats.P50 != 200 || stats.Min != 1 || stats.Max != 200 {
+		t.Errorf("got %+v after more samples", stats)
+	}
+
+	pm.ResetStats()
+	if stats := pm.StatsDetailed(); stats.P95 != 0 || stats.Max != 0 {
+		t.Errorf("got %+v after the reset", stats)
+	}
+}
+
+// Verifies the interpolated quantiles of known samples in GET /stats, and that invalid lists are rejected
+func TestStatsQuantiles(t *testing.T) {
+
+	pm := NewPasswordManager()
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+	pmh := NewPasswordManagerHandler(pm)
+
+	// 1ms to 100ms
+	for i := 1; i <= 100; i++ {
+		pm.pendingHashes++
+		pm.storeHash(int64(i), storedHash{hash: []byte("hash")}, now.Add(-time.Duration(i)*time.Millisecond))
+	}
+
+	stats := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		pmh.stats(w, httptest.NewRequest(http.MethodGet, "/stats?"+query, nil))
+		return w
+	}
+
+	w := stats("quantiles=0,0.5,0.9,0.99,1")
+	var res struct {
+		Quantiles map[string]float64 `json:"quantiles"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("stats returned '%s'", w.Body.String())
+	}
+	expected := map[string]float64{"0": 1, "0.5": 50.5, "0.9": 90.1, "0.99": 99.01, "1": 100}
+	for q, value := range expected {
+		if got, ok := res.Quantiles[q]; !ok || math.Abs(got-value) > 0.001 {
+			t.Errorf("quantile %s is %v, expected %v", q, got, value)
+		}
+	}
+
+	invalid := []string{"quantiles=0.5,", "quantiles=1.5", "quantiles=-0.1", "quantiles=NaN",
+		"quantiles=p99", "quantiles=" + strings.Repeat("0.5,", MaxQuantiles) + "0.5", "quantiles=0.5&approx=true"}
+	for _, query := range invalid {
+		if w := stats(query); w.Code != http.StatusBadRequest {
+			t.Errorf("'%s' returned %d", query, w.Code)
+		}
+	}
+
+	if w := stats(""); strings.Contains(w.Body.String(), "quantiles") {
+		t.Errorf("stats without quantiles returned '%s'", w.Body.String())
+	}
+}
+
+// Verifies the throughput for a known completion rate
+func TestThroughput(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.ThroughputWindow = 2*time.Second
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+
+	// 10 hashes per second for 5 seconds
+	for i := 0; i < 50; i++ {
+		pm.pendingHashes++
+		pm.storeHash(int64(i), storedHash{hash: []byte("hash")}, now)
+		now = now.Add(100*time.Millisecond)
+	}
+
+	if tp := pm.Throughput(); tp < 9 || tp > 11 {
+		t.Errorf("throughput is %f", tp)
+	}
+
+	now = now.Add(3*time.Second) // idle for longer than the window
+	if tp := pm.Throughput(); tp != 0 {
+		t.Errorf("throughput after idling is %f", tp)
+	}
+}
+
+// Verifies that query parameters don't affect the id of GET /hash/<id>
+func TestGetWithQuery(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.Lock()
+	pm.tasks[123] = storedHash{hash: []byte("some digest")}
+	pm.id = 124
+	pm.Unlock()
+
+	for _, target := range []string{"/hash/123?foo=bar", "/hash/123?encoding=hex&x=456"} {
+		id, err := parseHashID(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil || id != 123 {
+			t.Errorf("'%s' parsed as %d (%v)", target, id, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewPasswordManagerHandler(pm).get(w, httptest.NewRequest(http.MethodGet, "/hash/123?encoding=hex", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("get with query returned %d", w.Code)
+	}
+}
+
+// Verifies that DrainAll waits for pending hashes and returns all of them
+func TestDrainAll(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	for i := 0; i < 3; i++ {
+		pm.Hash("angryMonkey")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results := pm.DrainAll(ctx)
+	if len(results) != 3 {
+		t.Fatalf("got %d results", len(results))
+	}
+	for id := int64(0); id < 3; id++ {
+		if results[id] == nil {
+			t.Errorf("no result for id %d", id)
+		}
+	}
+	if pm.UnretrievedCount() != 0 {
+		t.Error("drained hashes are still retrievable")
+	}
+}
+
+// Verifies that DrainAll gives up when the context is done
+func TestDrainAllCancelled(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.Hash("angryMonkey")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if results := pm.DrainAll(ctx); len(results) != 0 {
+		t.Errorf("got %d results", len(results))
+	}
+}
+
+// Helper that gzips a request body
+func gzipBody(t *testing.T, body []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return &buf
+}
+
+// Verifies that gzip bodies are decompressed and that the size cap applies after decompression
+func TestGzipBody(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+
+	post := func(body *bytes.Buffer, encoding string) int {
+		w := httptest.NewRecorder()
+		req := newHashRequest(body)
+		req.Header.Set("Content-Encoding", encoding)
+		pmh.hash(w, req)
+		return w.Code
+	}
+
+	if code := post(gzipBody(t, []byte("password=angryMonkey")), "gzip"); code != http.StatusAccepted {
+		t.Errorf("gzip body returned %d", code)
+	}
+
+	// ~20KB compressed, 10MB decompressed
+	bomb := gzipBody(t, make([]byte, 10<<20))
+	if code := post(bomb, "gzip"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("decompression bomb returned %d", code)
+	}
+
+	if code := post(bytes.NewBufferString("password=angryMonkey"), "gzip"); code != http.StatusBadRequest {
+		t.Errorf("invalid gzip body returned %d", code)
+	}
+	if code := post(bytes.NewBufferString("password=angryMonkey"), "br"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported encoding returned %d", code)
+	}
+}
+
+// Verifies that polls before completion are reported with the hash
+func TestPendingPolls(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(200*time.Millisecond))
+	pmh := NewPasswordManagerHandler(pm)
+	id := pm.Hash("angryMonkey")
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/0", nil))
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := get(); w.Code != http.StatusAccepted || w.Body.String() != "{\"ready\": false}" {
+			t.Fatalf("pending poll returned %d '%s'", w.Code, w.Body.String())
+		}
+	}
+
+	ts := time.Now()
+	for pm.State(id) != TaskReady {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hash didn't complete in time")
+		}
+	}
+
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("ready hash returned %d", w.Code)
+	}
+	if polls := w.Header().Get("X-Pending-Polls"); polls != "3" {
+		t.Errorf("pending polls is '%s'", polls)
+	}
+	if pm.PendingPolls(id) != 0 {
+		t.Error("poll count is kept after retrieval")
+	}
+}
+
+// Verifies that admin operations racing a shutdown leave a consistent state; run with -race
+func TestAdminOperationsDuringShutdown(t *testing.T) {
+
+	for i := 0; i < 50; i++ {
+		pm := NewPasswordManager()
+		pmh := NewPasswordManagerHandler(pm)
+		pmh.AdminToken = []byte("secret")
+
+		var wg sync.WaitGroup
+		var resetCode, maintenanceCode int
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			pmh.shutdown()
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/admin/stats/reset", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			pmh.resetStats(w, req)
+			resetCode = w.Code
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader("enabled=true"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Bearer secret")
+			pmh.maintenance(w, req)
+			maintenanceCode = w.Code
+		}()
+		wg.Wait()
+
+		if !pm.IsShuttingDown() {
+			t.Fatal("shutdown didn't happen")
+		}
+		if resetCode != http.StatusNoContent && resetCode != http.StatusServiceUnavailable {
+			t.Errorf("reset returned %d", resetCode)
+		}
+		if (maintenanceCode == http.StatusOK) != pm.IsInMaintenance() {
+			t.Errorf("maintenance returned %d but maintenance is %t", maintenanceCode, pm.IsInMaintenance())
+		}
+	}
+}
+
+// Verifies that X-Hash-Delay overrides the nap only in test mode
+func TestHashDelayHeader(t *testing.T) {
+
+	post := func(testMode bool) PasswordManagerInterface {
+		pmh := NewPasswordManagerHandler(NewPasswordManager())
+		pmh.TestMode = testMode
+		w := httptest.NewRecorder()
+		req := newHashRequest(strings.NewReader("password=angryMonkey"))
+		req.Header.Set("X-Hash-Delay", "10ms")
+		pmh.hash(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("hash returned %d", w.Code)
+		}
+		return pmh.PasswordManager
+	}
+
+	pm := post(true)
+	time.Sleep(500*time.Millisecond)
+	if pm.State(0) != TaskReady {
+		t.Error("delay wasn't overridden in test mode")
+	}
+
+	pm = post(false)
+	time.Sleep(500*time.Millisecond)
+	if pm.State(0) != TaskPending {
+		t.Error("delay was overridden outside of test mode")
+	}
+}
+
+// Verifies that the shutdown hook fires once and can't block the shutdown
+func TestShutdownHook(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.ShutdownHookTimeout = 100*time.Millisecond
+
+	fired := make(chan bool, 2) // reports whether the shutdown had begun when the hook fired
+	pmh.OnShutdown = func() {
+		fired <- pmh.PasswordManager.IsShuttingDown()
+		time.Sleep(1*time.Hour) // hangs
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pmh.shutdown()
+		pmh.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5*time.Second):
+		t.Fatal("shutdown was blocked by the hook")
+	}
+
+	if len(fired) != 1 {
+		t.Fatalf("hook was called %d times", len(fired))
+	}
+	if !<-fired {
+		t.Error("hook was called before the shutdown began")
+	}
+}
+
+// Verifies that -shutdown-hook POSTs to its URL once the shutdown began
+func TestShutdownHookURL(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+
+	fired := make(chan bool, 2) // reports whether the shutdown had begun when the hook fired
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			t.Errorf("hook sent %s", req.Method)
+		}
+		fired <- pmh.PasswordManager.IsShuttingDown()
+	}))
+	defer srv.Close()
+
+	pmh.OnShutdown = shutdownHook(srv.URL+"/deregister", time.Second)
+	pmh.shutdown()
+
+	if len(fired) != 1 {
+		t.Fatalf("hook was called %d times", len(fired))
+	}
+	if !<-fired {
+		t.Error("hook was called before the shutdown began")
+	}
+}
+
+// Manager with a hash that never finishes
+type stuckManager struct {
+	*PasswordManager
+}
+
+func (sm stuckManager) PendingCount() int {
+	return 1
+}
+
+func (sm stuckManager) HasPendingHashes() bool {
+	return true
+}
+
+func (sm stuckManager) Drained() <-chan struct{} {
+	return nil // never closed
+}
+
+// Verifies that a shutdown gives up on pending hashes after the timeout
+func TestShutdownTimeout(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(stuckManager{NewPasswordManager()})
+	pmh.ShutdownTimeout = 100*time.Millisecond
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		pmh.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5*time.Second):
+		t.Fatal("shutdown didn't time out")
+	}
+
+	if elapsed := time.Since(start); elapsed < pmh.ShutdownTimeout {
+		t.Errorf("shutdown returned after %v, before the timeout", elapsed)
+	}
+}
+
+// Verifies that a shutdown returns once the pending hashes drain, without waiting for the timeout
+func TestShutdownDrains(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.ShutdownTimeout = 1*time.Hour
+	id := pm.Hash("angryMonkey")
+
+	done := make(chan struct{})
+	go func() {
+		pmh.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5*time.Second):
+		t.Fatal("shutdown didn't return after the hashes drained")
+	}
+
+	if peekHash(pm, id) == nil {
+		t.Error("shutdown returned before the hash was stored")
+	}
+}
+
+// Verifies that Drained is only closed once a shutdown is in progress and the pending hashes are done
+func TestDrained(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	pm.Hash("angryMonkey")
+
+	drained := func() bool {
+		select {
+		case <-pm.Drained():
+			return true
+		default:
+			return false
+		}
+	}
+
+	if drained() {
+		t.Error("drained before the shutdown")
+	}
+	pm.Shutdown()
+	if drained() {
+		t.Error("drained with a pending hash")
+	}
+
+	select {
+	case <-pm.Drained():
+	case <-time.After(5*time.Second):
+		t.Fatal("not drained after the hash was done")
+	}
+	if pm.HasPendingHashes() {
+		t.Error("drained before the hash was done")
+	}
+
+	idle := NewPasswordManager()
+	idle.Shutdown()
+	select {
+	case <-idle.Drained():
+	case <-time.After(1*time.Second):
+		t.Error("idle manager not drained right away")
+	}
+}
+
+// Verifies that waiting for the hash goroutines returns once they are done
+func TestWaitGroup(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	for i := 0; i < 10; i++ {
+		pm.Hash("angryMonkey")
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		pm.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5*time.Second):
+		t.Fatal("Wait didn't return")
+	}
+
+	if elapsed := time.Since(start); elapsed > 1*time.Second {
+		t.Errorf("Wait returned after %v", elapsed)
+	}
+	if pm.HasPendingHashes() {
+		t.Error("Wait returned with pending hashes")
+	}
+}
+
+// Verifies that a request in progress when the shutdown begins still completes
+func TestShutdownServer(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager(WithNap(0)))
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(100*time.Millisecond) // shutdown begins meanwhile
+		pmh.routes().ServeHTTP(w, req)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	type result struct {
+		code int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/health")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		res.Body.Close()
+		done <- result{code: res.StatusCode}
+	}()
+
+	<-started
+	if err := pmh.shutdownServer(srv); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("request failed: %v", res.err)
+	}
+	if res.code != http.StatusServiceUnavailable { // /health reports the shutdown
+		t.Errorf("got %d", res.code)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+// Verifies that draining the hashes and closing the connections share one shutdown timeout
+func TestShutdownServerTimeout(t *testing.T) {
+
+	pm := NewPasswordManager() // default nap, much longer than the test
+	pm.Hash("angryMonkey")
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.ShutdownTimeout = 300*time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release // keeps the connection open past the timeout
+	})}
+	go srv.Serve(ln)
+	go func() {
+		if res, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	ts := time.Now()
+	if err := pmh.shutdownServer(srv); err != context.DeadlineExceeded {
+		t.Errorf("shutdown returned %v", err)
+	}
+	if elapsed := time.Since(ts); elapsed > 2*pmh.ShutdownTimeout-50*time.Millisecond {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+}
+
+// Verifies that no hash starts once Shutdown returned, so the pending hashes drain
+func TestShutdownRace(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 0, WithNap(10*time.Millisecond))
+
+	var shutDown int32 // 1 once Shutdown returned
+	var late int32     // hashes started after that
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				done := atomic.LoadInt32(&shutDown) == 1
+				id := pm.Hash("angryMonkey")
+				if done && id >= 0 {
+					atomic.AddInt32(&late, 1)
+				}
+				if id == HashShuttingDown {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20*time.Millisecond)
+	pm.Shutdown()
+	atomic.StoreInt32(&shutDown, 1)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&late); n > 0 {
+		t.Errorf("%d hashes started after the shutdown", n)
+	}
+	select {
+	case <-pm.Drained():
+	case <-time.After(5*time.Second):
+		t.Fatalf("%d hashes still pending", pm.PendingCount())
+	}
+}
+
+// Verifies that cancelling the context during the nap drops the hash
+func TestHashCtxCancel(t *testing.T) {
+
+	pm := NewPasswordManager() // default nap, much longer than the test
+	ctx, cancel := context.WithCancel(context.Background())
+	id, err := pm.HashCtx(ctx, "angryMonkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-waitIdle(pm):
+	case <-time.After(2*time.Second):
+		t.Fatal("cancelled hash still pending")
+	}
+
+	pm.Lock()
+	tasks, pending := len(pm.tasks), len(pm.pending)
+	pm.Unlock()
+	if tasks != 0 || pending != 0 {
+		t.Errorf("%d tasks and %d pending after the cancellation", tasks, pending)
+	}
+	if hash, state := pm.Get(id); hash != nil || state != TaskCancelled {
+		t.Errorf("cancelled hash in state %v", state)
+	}
+
+	w := httptest.NewRecorder()
+	NewPasswordManagerHandler(pm).get(w, httptest.NewRequest(http.MethodGet, "/hash/"+strconv.FormatInt(id, 10), nil))
+	if w.Code != http.StatusGone || decodeError(t, w).Error != "Hash cancelled" {
+		t.Errorf("GET returned %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+// Verifies that a hash outlives the POST /hash request that started it
+//   - through a real server, which cancels the request context once the handler returned
+func TestHashOutlivesRequest(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	srv := httptest.NewServer(NewPasswordManagerHandler(pm).routes())
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashRes HashResponse
+	err = json.NewDecoder(res.Body).Decode(&hashRes)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-waitIdle(pm) // the request context is long done
+	if state := pm.State(hashRes.ID); state != TaskReady {
+		t.Errorf("hash in state %v", state)
+	}
+}
+
+// Verifies that HashCtx reports why it refused a hash
+func TestHashCtxErrors(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 1)
+	if _, err := pm.HashCtx(context.Background(), "angryMonkey"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := pm.HashCtx(context.Background(), "angryMonkey"); id != HashBusy || err != ErrHashBusy {
+		t.Errorf("busy returned %d, %v", id, err)
+	}
+
+	pm = NewPasswordManagerWithOptions(DefaultMaxEntries, 0) // the busy worker mustn't be reported first
+	pm.Shutdown()
+	if id, err := pm.HashCtx(context.Background(), "angryMonkey"); id != HashShuttingDown || err != ErrShuttingDown {
+		t.Errorf("shutdown returned %d, %v", id, err)
+	}
+}
+
+// Helper that returns a channel closed once pm has no pending hashes
+func waitIdle(pm *PasswordManager) <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		for pm.HasPendingHashes() {
+			time.Sleep(10*time.Millisecond)
+		}
+		close(idle)
+	}()
+
+	return idle
+}
+
+// Verifies that unretrieved hashes expire after the TTL
+func TestEntryTTL(t *testing.T) {
+
+	pm := NewPasswordManager(WithEntryTTL(1*time.Minute))
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+
+	pm.Lock()
+	pm.addTask(0, storedHash{hash: []byte("some digest")})
+	pm.addTask(1, storedHash{hash: []byte("other digest")})
+	pm.id = 2
+	pm.Unlock()
+
+	now = now.Add(59*time.Second)
+	if peekHash(pm, 0) == nil {
+		t.Fatal("hash expired early")
+	}
+
+	now = now.Add(1*time.Second)
+	if hash, state := pm.Get(0); hash != nil || state != TaskGone {
+		t.Errorf("expired hash returned '%s' in state %v", hash, state)
+	}
+
+	pm.Lock()
+	pm.expireTasks()
+	left := len(pm.tasks)
+	pm.Unlock()
+	if left != 0 {
+		t.Errorf("%d expired hashes left after the cleanup", left)
+	}
+}
+
+// Verifies that POST /hash and GET /hash/<id>/status tell clients by when to retrieve the hash
+func TestExpiresHeader(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(1*time.Second), WithEntryTTL(1*time.Minute))
+	now := time.Now().Truncate(time.Second) // Expires has second precision
+	pm.now = func() time.Time { return now }
+	mux := NewPasswordManagerHandler(pm).routes()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("hash returned %d", w.Code)
+	}
+	expected := now.Add(1*time.Minute).UTC().Format(http.TimeFormat)
+	if expires := w.Header().Get("Expires"); expires != expected {
+		t.Errorf("hash returned Expires '%s', expected '%s'", expires, expected)
+	}
+
+	<-waitIdle(pm)
+	now = now.Add(10*time.Second) // later than the completion, the expiry stays
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hash/0/status", nil))
+	if expires := w.Header().Get("Expires"); expires != expected {
+		t.Errorf("status returned Expires '%s', expected '%s'", expires, expected)
+	}
+
+	pm = NewPasswordManager(WithNap(0), WithEntryTTL(0))
+	w = httptest.NewRecorder()
+	NewPasswordManagerHandler(pm).hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if expires := w.Header().Get("Expires"); expires != "" {
+		t.Errorf("hash without TTL returned Expires '%s'", expires)
+	}
+}
+
+// Verifies that Shutdown stops the cleanup goroutine
+func TestCleanupStops(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.Shutdown()
+	pm.Shutdown()
+
+	select {
+	case <-pm.cleanupDone:
+	case <-time.After(5*time.Second):
+		t.Fatal("cleanup goroutine still running")
+	}
+}
+
+// Helper that returns the hash of task id without removing it
+func peekHash(pm *PasswordManager, id int64) []byte {
+	pwdHash, _ := pm.Peek(id)
+	return pwdHash
+}
+
+// Verifies that GET /hash/<id>/status reports if a hash is ready without consuming it
+func TestHashStatus(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pmh := NewPasswordManagerHandler(pm)
+	mux := pmh.routes()
+	pm.Lock()
+	pm.tasks[0] = storedHash{hash: []byte("some digest")}
+	pm.pending[1] = true
+	pm.id = 2
+	pm.Unlock()
+
+	status := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hash/"+id+"/status", nil))
+		return w
+	}
+
+	for id, expected := range map[string]string{"0": "{\"ready\": true}", "1": "{\"ready\": false}"} {
+		if w := status(id); w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("status of %s returned %d '%s'", id, w.Code, w.Body.String())
+		}
+	}
+	if peekHash(pm, 0) == nil {
+		t.Error("status consumed the hash")
+	}
+
+	if w := status("42"); w.Code != http.StatusNotFound {
+		t.Errorf("status of unknown hash returned %d", w.Code)
+	}
+	if w := status("x"); w.Code != http.StatusBadRequest {
+		t.Errorf("status of invalid id returned %d", w.Code)
+	}
+}
+
+// Verifies that DELETE /hash/<id> discards the hash
+func TestDeleteHash(t *testing.T) {
+
+	pm := NewPasswordManager()
+	mux := NewPasswordManagerHandler(pm).routes()
+	pm.Lock()
+	pm.addTask(0, storedHash{hash: []byte("some digest")})
+	pm.id = 1
+	pm.Unlock()
+
+	request := func(method string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/hash/0", nil))
+		return w.Code
+	}
+
+	if code := request(http.MethodDelete); code != http.StatusNoContent {
+		t.Errorf("DELETE returned %d", code)
+	}
+	if code := request(http.MethodGet); code != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d", code)
+	}
+	if code := request(http.MethodDelete); code != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d", code)
+	}
+	if n := pm.UnretrievedCount(); n != 0 {
+		t.Errorf("%d hashes left", n)
+	}
+}
+
+// Verifies that DELETE /hash/<id> of a hash that is still calculated discards the result
+func TestDeletePendingHash(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	mux := NewPasswordManagerHandler(pm).routes()
+	id := pm.Hash("angryMonkey")
+
+	request := func(method string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/hash/"+strconv.FormatInt(id, 10), nil))
+		return w.Code
+	}
+
+	if code := request(http.MethodDelete); code != http.StatusNoContent {
+		t.Errorf("DELETE returned %d", code)
+	}
+	if !pm.HasPendingHashes() {
+		t.Error("calculation of the deleted hash isn't pending anymore")
+	}
+
+	<-waitIdle(pm)
+	if n := pm.UnretrievedCount(); n != 0 {
+		t.Errorf("%d hashes stored after the calculation", n)
+	}
+	if code := request(http.MethodGet); code != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d", code)
+	}
+}
+
+// Verifies that deleted, failed and cancelled ids aren't remembered forever
+func TestMarkersBounded(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(3, 0, WithEntryTTL(1*time.Minute))
+	now := time.Now()
+	pm.now = func() time.Time { return now }
+	pm.Lock()
+	for id := int64(0); id < 3; id++ {
+		pm.addTask(id, storedHash{hash: []byte("hash")})
+	}
+	pm.id = 4
+	pm.pending[3] = true
+	pm.Unlock()
+
+	for id := int64(0); id < 4; id++ {
+		if !pm.Delete(id) {
+			t.Fatalf("hash %d wasn't deleted", id)
+		}
+	}
+	for id := int64(0); id < 4; id++ { // the pending hash doesn't count yet
+		if state := pm.State(id); state != TaskDeleted {
+			t.Errorf("deleted hash %d in state %v", id, state)
+		}
+	}
+
+	pm.pendingHashes++
+	pm.storeHash(3, storedHash{hash: []byte("hash")}, now)
+	if state := pm.State(3); state != TaskDeleted {
+		t.Errorf("hash deleted while pending in state %v", state)
+	}
+	if state := pm.State(0); state != TaskGone {
+		t.Errorf("oldest marker in state %v", state)
+	}
+
+	now = now.Add(2*time.Minute)
+	pm.Lock()
+	pm.expireMarkers()
+	markers, deleted := pm.markers.Len(), len(pm.deleted)
+	pm.Unlock()
+	if markers != 0 || deleted != 0 {
+		t.Errorf("%d markers and %d deleted ids after the TTL", markers, deleted)
+	}
+}
+
+// Verifies that HEAD /hash/<id> reports readiness without a body and without consuming the hash
+func TestHeadHash(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(50*time.Millisecond))
+	mux := NewPasswordManagerHandler(pm).routes()
+	id := pm.Hash("angryMonkey")
+
+	head := func(id int64) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/hash/"+strconv.FormatInt(id, 10), nil))
+		return w
+	}
+
+	if w := head(id); w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+		t.Errorf("HEAD during the nap returned %d '%s'", w.Code, w.Body.String())
+	}
+
+	<-waitIdle(pm)
+	if w := head(id); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD after the nap returned %d '%s'", w.Code, w.Body.String())
+	}
+	if peekHash(pm, id) == nil {
+		t.Error("HEAD consumed the hash")
+	}
+
+	if w := head(42); w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("HEAD of an unknown hash returned %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+// Verifies that POST /hash/batch starts a hash per password
+func TestHashBatch(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	mux := NewPasswordManagerHandler(pm).routes()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hash/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("{\"passwords\": [\"p1\", \"p2\", \"p3\"]}")
+	var res BatchHashResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); w.Code != http.StatusAccepted || err != nil {
+		t.Fatalf("batch returned %d '%s'", w.Code, w.Body.String())
+	}
+	if len(res.IDs) != 3 {
+		t.Fatalf("got ids %v", res.IDs)
+	}
+
+	<-waitIdle(pm)
+	hashes := make(map[string]bool)
+	for _, id := range res.IDs {
+		hash, _ := pm.Get(id)
+		if hash == nil {
+			t.Fatalf("no hash for id %d", id)
+		}
+		hashes[string(hash)] = true
+	}
+	if len(hashes) != 3 {
+		t.Errorf("%d distinct hashes for 3 passwords", len(hashes))
+	}
+
+	pwds := make([]string, MaxBatchSize+1)
+	for i := range pwds {
+		pwds[i] = "angryMonkey"
+	}
+	tooMany, _ := json.Marshal(BatchHashRequest{Passwords: pwds})
+	if w := post(string(tooMany)); w.Code != http.StatusBadRequest {
+		t.Errorf("oversized batch returned %d", w.Code)
+	}
+	if w := post("{\"passwords\": []}"); w.Code != http.StatusBadRequest {
+		t.Errorf("empty batch returned %d", w.Code)
+	}
+}
+
+// Verifies that a batch starts all of its hashes or none
+func TestHashBatchAllOrNone(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 3) // default nap, much longer than the test
+	pmh := NewPasswordManagerHandler(pm)
+	mux := pmh.routes()
+
+	post := func(n int) *httptest.ResponseRecorder {
+		pwds := make([]string, n)
+		for i := range pwds {
+			pwds[i] = "angryMonkey"
+		}
+		body, _ := json.Marshal(BatchHashRequest{Passwords: pwds})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hash/batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(4); w.Code != http.StatusBadRequest {
+		t.Errorf("batch larger than the workers returned %d", w.Code)
+	}
+
+	pm.Hash("angryMonkey")
+	if w := post(3); w.Code != http.StatusTooManyRequests {
+		t.Errorf("batch without enough free workers returned %d", w.Code)
+	}
+	if n := pm.PendingCount(); n != 1 {
+		t.Errorf("%d hashes pending after the rejected batch", n)
+	}
+	if w := post(2); w.Code != http.StatusAccepted {
+		t.Errorf("batch with enough free workers returned %d", w.Code)
+	}
+
+	pm = NewPasswordManagerWithOptions(DefaultMaxEntries, 3)
+	pm.Shutdown()
+	if ids, err := pm.HashBatch([]string{"p1", "p2"}); ids != nil || err != ErrShuttingDown {
+		t.Errorf("batch during shutdown returned %v, %v", ids, err)
+	}
+	if len(pm.workerPool) != 0 || pm.PendingCount() != 0 {
+		t.Error("batch during shutdown kept workers or hashes")
+	}
+}
+
+// Verifies that every password of a batch counts against the rate limit
+func TestHashBatchRateLimit(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.RateLimiter = NewRateLimiter(1, 5)
+	mux := pmh.routes()
+
+	post := func(n int) int {
+		pwds := make([]string, n)
+		for i := range pwds {
+			pwds[i] = "angryMonkey"
+		}
+		body, _ := json.Marshal(BatchHashRequest{Passwords: pwds})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hash/batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(6); code != http.StatusTooManyRequests {
+		t.Errorf("batch larger than the burst returned %d", code)
+	}
+	if code := post(3); code != http.StatusAccepted {
+		t.Errorf("first batch returned %d", code)
+	}
+	if code := post(3); code != http.StatusTooManyRequests {
+		t.Errorf("batch over the rate returned %d", code)
+	}
+}
+
+// Verifies that POST /hash/verify checks a password against a stored hash without removing it
+func TestVerifyID(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	mux := NewPasswordManagerHandler(pm).routes()
+	id := pm.Hash("angryMonkey")
+	<-waitIdle(pm)
+
+	verify := func(id int64, pwd string) string {
+		w := httptest.NewRecorder()
+		body, _ := json.Marshal(VerifyIDRequest{ID: id, Password: pwd})
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hash/verify", bytes.NewReader(body)))
+		return w.Body.String()
+	}
+
+	if body := verify(id, "angryMonkey"); body != "{\"match\": true}" {
+		t.Errorf("match returned '%s'", body)
+	}
+	if body := verify(id, "angryDonkey"); body != "{\"match\": false}" {
+		t.Errorf("mismatch returned '%s'", body)
+	}
+	if body := verify(42, "angryMonkey"); body != "{\"match\": false}" {
+		t.Errorf("unknown id returned '%s'", body)
+	}
+	if peekHash(pm, id) == nil {
+		t.Error("verify removed the hash")
+	}
+}
+
+// Verifies that a hash refuses further checks after too many mismatches, and that /hash/verify is rate limited
+func TestVerifyIDLimits(t *testing.T) {
+
+	pm := NewPasswordManager(WithNap(0))
+	pmh := NewPasswordManagerHandler(pm)
+	mux := pmh.routes()
+	id := pm.Hash("angryMonkey")
+	<-waitIdle(pm)
+
+	verify := func(pwd string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body, _ := json.Marshal(VerifyIDRequest{ID: id, Password: pwd})
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hash/verify", bytes.NewReader(body)))
+		return w
+	}
+
+	if w := verify("angryMonkey"); w.Body.String() != "{\"match\": true}" { // matches don't count
+		t.Errorf("match returned '%s'", w.Body.String())
+	}
+	for i := 0; i < MaxVerifyFailures; i++ {
+		if w := verify("angryDonkey"); w.Code != http.StatusOK {
+			t.Fatalf("mismatch %d returned %d", i, w.Code)
+		}
+	}
+	for _, pwd := range []string{"angryDonkey", "angryMonkey"} {
+		if w := verify(pwd); w.Code != http.StatusTooManyRequests {
+			t.Errorf("'%s' after %d mismatches returned %d", pwd, MaxVerifyFailures, w.Code)
+		}
+	}
+
+	pmh.RateLimiter = NewRateLimiter(1, 1)
+	mux = pmh.routes()
+	id = pm.Hash("angryMonkey")
+	<-waitIdle(pm)
+	if w := verify("angryMonkey"); w.Code != http.StatusOK {
+		t.Errorf("first verify returned %d", w.Code)
+	}
+	if w := verify("angryMonkey"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("verify over the rate returned %d", w.Code)
+	}
+}
+
+// Verifies that /metrics exposes the hash metrics
+func TestMetrics(t *testing.T) {
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	pm := NewPasswordManager(WithNap(0), WithMetrics(metrics))
+	pmh := NewPasswordManagerHandler(pm)
+	pmh.Metrics = metrics
+	mux := pmh.routes()
+
+	mux.ServeHTTP(httptest.NewRecorder(), newHashRequest(strings.NewReader("password=angryMonkey")))
+	<-waitIdle(pm)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"passwordservice_hash_requests_total 1",
+		"passwordservice_hash_duration_seconds_count 1",
+		"passwordservice_hash_duration_seconds_bucket{le=\"10\"} 1",
+		"passwordservice_pending_hashes 0",
+		"passwordservice_hash_errors_total 0",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("'%s' missing in '%s'", line, w.Body.String())
+		}
+	}
+}
+
+// Verifies that consume=false leaves the hash in place and the default consumes it
+func TestGetConsume(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pmh := NewPasswordManagerHandler(pm)
+	pm.Lock()
+	pm.tasks[0] = storedHash{hash: []byte("some digest")}
+	pm.id = 1
+	pm.Unlock()
+
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		pmh.get(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := get("/hash/0?consume=false"); code != http.StatusOK {
+			t.Fatalf("non-consuming get returned %d", code)
+		}
+	}
+	if pm.State(0) != TaskReady {
+		t.Error("non-consuming get removed the hash")
+	}
+
+	if code := get("/hash/0?consume=true"); code != http.StatusOK {
+		t.Fatalf("consuming get returned %d", code)
+	}
+	if code := get("/hash/0"); code != http.StatusGone {
+		t.Errorf("hash is still there after consuming it: %d", code)
+	}
+
+	if code := get("/hash/0?consume=maybe"); code != http.StatusBadRequest {
+		t.Errorf("invalid consume parameter returned %d", code)
+	}
+}
+
+// Verifies that disabling keep-alives closes the connection after each response
+func TestKeepAlivesDisabled(t *testing.T) {
+
+	for _, keepAlives := range []bool{true, false} {
+		pmh := NewPasswordManagerHandler(NewPasswordManager())
+		srv := newServer(Config{Port: 1, KeepAlives: keepAlives}, http.HandlerFunc(pmh.stats))
+		srv.Addr = "127.0.0.1:0"
+		ln, err := listen(srv, Config{TCPKeepAlive: 30*time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(ln)
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+
+		if resp.Close == keepAlives {
+			t.Errorf("keep-alives %t but Connection: close is %t", keepAlives, resp.Close)
+		}
+	}
+}
+
+// Reader that trickles one byte at a time, like a slow client
+type slowReader struct {
+	r io.Reader
+}
+
+func (sr slowReader) Read(p []byte) (int, error) {
+	time.Sleep(1*time.Millisecond)
+	return sr.r.Read(p[:1])
+}
+
+// Verifies that the body read stops when the request is cancelled
+func TestBodyReadCancelled(t *testing.T) {
+
+	pm := NewPasswordManager()
+	body := slowReader{strings.NewReader("password=" + strings.Repeat("a", 3000))} // ~3s to read
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newHashRequest(body).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	ts := time.Now()
+	NewPasswordManagerHandler(pm).hash(httptest.NewRecorder(), req)
+	if elapsed := time.Now().Sub(ts); elapsed > 1*time.Second {
+		t.Errorf("handler kept reading for %v", elapsed)
+	}
+	if pm.HasPendingHashes() {
+		t.Error("cancelled request was processed")
+	}
+}
+
+// Verifies that retrieved hashes aren't cacheable by default
+func TestGetCacheControl(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.Lock()
+	pm.tasks[0] = storedHash{hash: []byte("some digest")}
+	pm.id = 1
+	pm.Unlock()
+
+	pmh := NewPasswordManagerHandler(pm)
+	w := httptest.NewRecorder()
+	pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/0", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("got %d with Cache-Control '%s'", w.Code, w.Header().Get("Cache-Control"))
+	}
+
+	pmh.CacheControl = "private, max-age=0"
+	w = httptest.NewRecorder()
+	pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/0", nil))
+	if w.Header().Get("Cache-Control") != "private, max-age=0" {
+		t.Errorf("got Cache-Control '%s'", w.Header().Get("Cache-Control"))
+	}
+}
+
+// Verifies that hashes are rejected once the budget is used up, until it's reset
+func TestCPUBudget(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.CPUBudget = 10*time.Millisecond
+	pmh := NewPasswordManagerHandler(pm)
+
+	post := func() int {
+		w := httptest.NewRecorder()
+		pmh.hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+		return w.Code
+	}
+
+	pm.addCPUTime(5*time.Millisecond)
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("hash within budget returned %d", code)
+	}
+
+	pm.addCPUTime(5*time.Millisecond)
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Errorf("hash over budget returned %d", code)
+	}
+
+	pmh.AdminToken = []byte("secret")
+	w := httptest.NewRecorder()
+	pmh.resetBudget(w, httptest.NewRequest(http.MethodPost, "/admin/budget/reset", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("budget reset without token returned %d", w.Code)
+	}
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Errorf("hash after budget reset without token returned %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/budget/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	pmh.resetBudget(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("budget reset returned %d", w.Code)
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("hash after budget reset returned %d", code)
+	}
+}
+
+// Verifies that approximate stats don't wait for the lock
+func TestApproxStats(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.pendingHashes++
+	pm.storeHash(0, storedHash{hash: []byte("hash")}, time.Now().Add(-2*time.Second))
+	pmh := NewPasswordManagerHandler(pm)
+
+	pm.Lock() // heavy contention
+	done := make(chan string, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		pmh.stats(w, httptest.NewRequest(http.MethodGet, "/stats?approx=true", nil))
+		done <- w.Body.String()
+	}()
+
+	select {
+	case body := <-done:
+		if !strings.HasPrefix(body, "{\"total\": 1, \"average\": 2000, ") {
+			t.Errorf("unexpected stats '%s'", body)
+		}
+	case <-time.After(1*time.Second):
+		t.Error("approximate stats blocked on the lock")
+	}
+	pm.Unlock()
+
+	w := httptest.NewRecorder()
+	pmh.stats(w, httptest.NewRequest(http.MethodGet, "/stats?approx=false", nil))
+	if !strings.Contains(w.Body.String(), "\"unretrieved\": 1") {
+		t.Errorf("unexpected exact stats '%s'", w.Body.String())
+	}
+}
+
+// Verifies that requests without the required header are rejected
+func TestRequiredHeader(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.RequiredHeader = "X-Gateway-Auth"
+	pmh.RequiredHeaderValue = []byte("gateway")
+	handler := pmh.requireHeader(http.HandlerFunc(pmh.stats))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without header returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("X-Gateway-Auth", "gateway")
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("request with header returned %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("X-Gateway-Auth", "client")
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request with wrong header value returned %d", w.Code)
+	}
+
+	handler = pmh.requireHeader(pmh.routes())
+	for _, path := range []string{"/health", "/live", "/ready"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("probe %s without header returned %d", path, w.Code)
+		}
+	}
+}
+
+// Verifies that sequential hashes of the same password split into different 80 byte salt || digest blobs
+func TestSplitSaltAndHash(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.HashWithDelay("angryMonkey", 0)
+	pm.HashWithDelay("angryMonkey", 0)
+
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+
+	first, _ := pm.Get(0)
+	second, _ := pm.Get(1)
+	if bytes.Equal(first, second) {
+		t.Error("identical passwords have identical hashes")
+	}
+
+	for _, blob := range [][]byte{first, second} {
+		salt, hash, err := SplitSaltAndHash(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(salt)+len(hash) != 80 || len(salt) != SaltLen {
+			t.Errorf("salt is %d bytes, hash %d", len(salt), len(hash))
+		}
+		if digest := saltedSHA512(salt, "angryMonkey"); !bytes.Equal(digest[:], hash) {
+			t.Error("digest mismatch")
+		}
+	}
+
+	if _, _, err := SplitSaltAndHash(first[:40]); err == nil {
+		t.Error("short blob accepted")
+	}
+	if _, _, err := SplitSaltAndHash([]byte("\x02$2a$10$")); err == nil {
+		t.Error("bcrypt hash accepted")
+	}
+}
+
+// Verifies that stats name the instance and carry a recent timestamp
+func TestStatsSource(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.InstanceID = "pws-1"
+
+	for _, url := range []string{"/stats", "/stats?approx=true"} {
+		w := httptest.NewRecorder()
+		pmh.stats(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		var stats struct {
+			Instance string
+			Timestamp time.Time
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+		if stats.Instance != "pws-1" {
+			t.Errorf("%s: instance is '%s'", url, stats.Instance)
+		}
+		if age := time.Since(stats.Timestamp); age < -1*time.Second || age > 5*time.Second {
+			t.Errorf("%s: timestamp is %v old", url, age)
+		}
+	}
+}
+
+// Verifies that a panicking hasher fails the task instead of crashing the process
+func TestHasherPanic(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pm.hasher = func(Algorithm, HashParams, string, []byte) (storedHash, error) {
+		panic("buggy hasher")
+	}
+	pmh := NewPasswordManagerHandler(pm)
+
+	id := pm.HashWithDelay("angryMonkey", 0)
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hash didn't fail in time")
+		}
+	}
+
+	if state := pm.State(id); state != TaskFailed {
+		t.Errorf("state is %d", state)
+	}
+
+	w := httptest.NewRecorder()
+	pmh.get(w, httptest.NewRequest(http.MethodGet, "/hash/"+strconv.FormatInt(id, 10), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("failed hash returned %d", w.Code)
+	}
+}
+
+// Verifies that a full manager evicts the least recently used hash
+func TestMaxEntries(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(3, 0)
+	for i := 0; i < 5; i++ {
+		pm.pendingHashes++
+		pm.storeHash(int64(i), storedHash{hash: []byte("hash")}, time.Now())
+		if i == 2 {
+			pm.Peek(1) // keeps 1 over 0 and 2
+		}
+	}
+	pm.id = 5
+
+	if n := pm.UnretrievedCount(); n != 3 {
+		t.Errorf("%d unretrieved hashes", n)
+	}
+	for _, id := range []int64{0, 2} {
+		if state := pm.State(id); state != TaskGone {
+			t.Errorf("hash %d wasn't evicted", id)
+		}
+	}
+	for _, id := range []int64{1, 3, 4} {
+		if pwdHash, _ := pm.Get(id); pwdHash == nil {
+			t.Errorf("hash %d was evicted", id)
+		}
+	}
+
+	if evicted := pm.StatsDetailed().Evicted; evicted != 2 {
+		t.Errorf("%d evictions counted", evicted)
+	}
+	w := httptest.NewRecorder()
+	NewPasswordManagerHandler(pm).stats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Evicted int64 `json:"evicted"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Evicted != 2 {
+		t.Errorf("/stats returned '%s'", w.Body.String())
+	}
+
+	pm.ResetStats()
+	if evicted := pm.StatsDetailed().Evicted; evicted != 0 {
+		t.Errorf("%d evictions after the reset", evicted)
+	}
+}
+
+// Verifies that the worker pool caps concurrent hashes and that POST /hash gets a 429 once it's full
+func TestWorkers(t *testing.T) {
+
+	const workers = 2
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, workers)
+	release := make(chan struct{})
+	var running, maxRunning int32
+	pm.hasher = func(algo Algorithm, params HashParams, pwd string, salt []byte) (storedHash, error) {
+		n := atomic.AddInt32(&running, 1)
+		for max := atomic.LoadInt32(&maxRunning); n > max && !atomic.CompareAndSwapInt32(&maxRunning, max, n); {
+			max = atomic.LoadInt32(&maxRunning)
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return hashPassword(algo, params, pwd, salt)
+	}
+	pmh := NewPasswordManagerHandler(pm)
+	post := func() int {
+		w := httptest.NewRecorder()
+		pmh.hash(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+		return w.Code
+	}
+
+	for i := 0; i < workers; i++ {
+		if id := pm.HashWithDelay("angryMonkey", 0); id != int64(i) {
+			t.Fatalf("hash %d got id %d", i, id)
+		}
+	}
+	if id := pm.HashWithDelay("angryMonkey", 0); id != -1 {
+		t.Errorf("hash with a full pool got id %d", id)
+	}
+	if code := post(); code != http.StatusTooManyRequests {
+		t.Errorf("hash with a full pool returned %d", code)
+	}
+
+	close(release)
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+	if max := atomic.LoadInt32(&maxRunning); max > workers {
+		t.Errorf("%d hashes ran concurrently", max)
+	}
+
+	// slots are released once a hash is stored
+	for pm.HashWithDelay("angryMonkey", 0) < 0 {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("pool slots weren't released")
+		}
+	}
+}
+
+// Benchmarks concurrent hash submissions through the worker pool
+func BenchmarkHashParallel(b *testing.B) {
+
+	pm := NewPasswordManager()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pm.HashWithDelay("angryMonkey", 0) // refused submissions are part of the load
+		}
+	})
+	b.StopTimer()
+
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+// Helper that returns a manager holding n ready hashes with ids 0 to n-1
+func newBenchmarkManager(n int) *PasswordManager {
+	pm := NewPasswordManagerWithOptions(0, 0)
+	pm.Lock()
+	for id := int64(0); id < int64(n); id++ {
+		pm.addTask(id, storedHash{hash: []byte("hash")})
+	}
+	pm.id = int64(n)
+	pm.Unlock()
+
+	return pm
+}
+
+// Benchmarks retrieving hashes one after another, the baseline for BenchmarkGetParallel
+func BenchmarkGet(b *testing.B) {
+
+	pm := newBenchmarkManager(b.N)
+	b.ResetTimer()
+	for id := int64(0); id < int64(b.N); id++ {
+		pm.Get(id)
+	}
+}
+
+// Benchmarks concurrent retrievals, which all serialize on the manager mutex
+func BenchmarkGetParallel(b *testing.B) {
+
+	pm := newBenchmarkManager(b.N)
+	var next int64 = -1
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pm.Get(atomic.AddInt64(&next, 1))
+		}
+	})
+}
+
+// Verifies that verify-only mode serves /verify but not /hash
+func TestVerifyOnly(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	pmh.VerifyOnly = true
+	mux := pmh.routes()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newHashRequest(strings.NewReader("password=angryMonkey")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/hash returned %d", w.Code)
+	}
+
+	sh, _ := hashPassword(SHA512, DefaultHashParams, "angryMonkey", newSalt())
+	hash := base64.StdEncoding.EncodeToString(sh.bytes())
+	verify := func(pwd string) string {
+		w := httptest.NewRecorder()
+		body := "{\"password\": \"" + pwd + "\", \"hash\": \"" + hash + "\"}"
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(body)))
+		return w.Body.String()
+	}
+
+	if body := verify("angryMonkey"); body != "{\"valid\": true}" {
+		t.Errorf("matching password returned '%s'", body)
+	}
+	if body := verify("angryMonkey2"); body != "{\"valid\": false}" {
+		t.Errorf("other password returned '%s'", body)
+	}
+}
+
+// Verifies that /verify takes a worker, and is rejected while they're busy, over the rate or in maintenance
+func TestVerifyLimits(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 1, WithNap(0))
+	pmh := NewPasswordManagerHandler(pm)
+	mux := pmh.routes()
+
+	sh, _ := hashPassword(SHA512, DefaultHashParams, "angryMonkey", newSalt())
+	body := "{\"password\": \"angryMonkey\", \"hash\": \"" + base64.StdEncoding.EncodeToString(sh.bytes()) + "\"}"
+	verify := func() int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := verify(); code != http.StatusOK {
+		t.Errorf("idle verify returned %d", code)
+	}
+
+	pm.HashWithDelay("angryMonkey", time.Second) // holds the only worker
+	if code := verify(); code != http.StatusTooManyRequests {
+		t.Errorf("verify with busy workers returned %d", code)
+	}
+	<-waitIdle(pm)
+
+	pm.SetMaintenance(true)
+	if code := verify(); code != http.StatusServiceUnavailable {
+		t.Errorf("verify in maintenance returned %d", code)
+	}
+	pm.SetMaintenance(false)
+
+	pmh.RateLimiter = NewRateLimiter(1, 1)
+	mux = pmh.routes()
+	if code := verify(); code != http.StatusOK {
+		t.Errorf("first verify returned %d", code)
+	}
+	if code := verify(); code != http.StatusTooManyRequests {
+		t.Errorf("verify over the rate returned %d", code)
+	}
+}
+
+// Verifies that /verify rejects hashes whose recorded cost exceeds MaxHashParams before deriving anything
+func TestVerifyCost(t *testing.T) {
+
+	mux := NewPasswordManagerHandler(NewPasswordManager()).routes()
+
+	sh, _ := hashPassword(Argon2id, DefaultHashParams, "angryMonkey", newSalt())
+	inflated := bytes.Replace(sh.bytes(), []byte(",t=1,"), []byte(",t=40,"), 1)
+	body := "{\"password\": \"angryMonkey\", \"hash\": \"" + base64.StdEncoding.EncodeToString(inflated) + "\"}"
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("inflated argon2id cost returned %d", w.Code)
+	}
+	if VerifyPassword("angryMonkey", inflated) {
+		t.Error("inflated argon2id cost verifies")
+	}
+
+	hashes := map[string][]byte{
+		"bcrypt": append([]byte{VersionBcrypt}, "$2a$31$"+strings.Repeat("a", 53)...),
+		"scrypt": append([]byte{VersionScrypt}, "$scrypt$ln=30,r=8,p=1$c2FsdA$a2V5"...),
+		"argon2id memory": append([]byte{VersionArgon2id}, "$argon2id$v=19$m=4194304,t=1,p=4$c2FsdA$a2V5"...),
+	}
+	for name, pwdHash := range hashes {
+		if err := CheckHashCost(pwdHash); err != ErrHashCost {
+			t.Errorf("%s: returned %v", name, err)
+		}
+	}
+	if err := CheckHashCost(sh.bytes()); err != nil {
+		t.Errorf("default cost returned %v", err)
+	}
+}
+
+// Verifies that the pending counter stays consistent under 1000 concurrent hashes; run with -race
+func TestConcurrentPendingCount(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 0)
+	done := make(chan struct{})
+	negative := make(chan int, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := pm.PendingCount(); n < 0 {
+				negative <- n
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pm.HashWithDelay("angryMonkey", 0)
+		}()
+	}
+	wg.Wait()
+
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+	close(done)
+
+	select {
+	case n := <-negative:
+		t.Errorf("pending count went to %d", n)
+	default:
+	}
+	if n := pm.UnretrievedCount(); n != 1000 {
+		t.Errorf("%d hashes completed", n)
+	}
+}
+
+// Verifies that /health reports pending hashes and turns to draining on shutdown
+func TestHealth(t *testing.T) {
+
+	pm := NewPasswordManager()
+	pmh := NewPasswordManagerHandler(pm)
+	pm.Hash("angryMonkey")
+
+	health := func(method string) (int, HealthResponse) {
+		w := httptest.NewRecorder()
+		pmh.health(w, httptest.NewRequest(method, "/health", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=UTF-8" {
+			t.Errorf("%s /health returned Content-Type '%s'", method, ct)
+		}
+		var res HealthResponse
+		if w.Code == http.StatusOK || w.Code == http.StatusServiceUnavailable {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Errorf("invalid JSON '%s': %v", w.Body.String(), err)
+			}
+		}
+		return w.Code, res
+	}
+
+	if code, res := health(http.MethodGet); code != http.StatusOK || res != (HealthResponse{Status: "ok", PendingHashes: 1}) {
+		t.Errorf("got %d %+v", code, res)
+	}
+	if code, _ := health(http.MethodPost); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /health returned %d", code)
+	}
+
+	pm.Shutdown()
+	if code, res := health(http.MethodGet); code != http.StatusServiceUnavailable || res != (HealthResponse{Status: "draining", PendingHashes: 1, ShuttingDown: true}) {
+		t.Errorf("got %d %+v while draining", code, res)
+	}
+}
+
+// Verifies that /live always answers 200 while /ready turns to 503 when saturated and on shutdown
+func TestLiveReady(t *testing.T) {
+
+	pm := NewPasswordManagerWithOptions(DefaultMaxEntries, 1, WithNap(1*time.Minute))
+	pmh := NewPasswordManagerHandler(pm)
+	mux := pmh.routes()
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := get("/live"); code != http.StatusOK {
+		t.Errorf("/live returned %d", code)
+	}
+	if code := get("/ready"); code != http.StatusOK {
+		t.Errorf("/ready returned %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pm.HashCtx(ctx, "angryMonkey") // takes the only worker
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready returned %d while saturated", code)
+	}
+	cancel()
+	<-waitIdle(pm)
+
+	pm.Shutdown()
+	if code := get("/live"); code != http.StatusOK {
+		t.Errorf("/live returned %d after the shutdown", code)
+	}
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready returned %d after the shutdown", code)
+	}
+}
+
+// Verifies that GET /ready?verbose=true reports each check, and that a failing store fails readiness
+func TestReadyVerbose(t *testing.T) {
+
+	pm := NewPasswordManager()
+	mux := NewPasswordManagerHandler(pm).routes()
+
+	ready := func() (int, ReadyReport) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready?verbose=true", nil))
+		var report ReadyReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("/ready returned '%s'", w.Body.String())
+		}
+		return w.Code, report
+	}
+
+	code, report := ready()
+	if code != http.StatusOK || report.Status != "ready" || len(report.Checks) != 3 {
+		t.Errorf("/ready returned %d %+v", code, report)
+	}
+
+	pm.Lock()
+	pm.logStoreError(errors.New("disk full"))
+	pm.Unlock()
+	code, report = ready()
+	if code != http.StatusServiceUnavailable || report.Status != "unavailable" {
+		t.Errorf("/ready with a failing store returned %d %+v", code, report)
+	}
+	for _, check := range report.Checks {
+		if failing := check.Name == "store"; check.OK == failing || (failing && check.Error != "disk full") {
+			t.Errorf("unexpected check %+v", check)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready with a failing store returned %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready?verbose=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid verbose parameter returned %d", w.Code)
+	}
+}
+
+// Verifies that exported hashes can be retrieved after importing them into another manager
+func TestExportImport(t *testing.T) {
+
+	src := NewPasswordManager(WithNap(0))
+	src.Hash("angryMonkey")
+	src.Hash("angryMonkey2")
+	ts := time.Now()
+	for src.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+	src.Get(1)
+
+	srcHandler := NewPasswordManagerHandler(src)
+	srcHandler.AdminToken = []byte("secret")
+	request := func(pmh *PasswordManagerHandler, method string, body string, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/admin/export", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if method == http.MethodGet {
+			pmh.export(w, req)
+		} else {
+			pmh.importTasks(w, req)
+		}
+		return w
+	}
+
+	if w := request(srcHandler, http.MethodGet, "", "guess"); w.Code != http.StatusUnauthorized {
+		t.Errorf("export with wrong token returned %d", w.Code)
+	}
+	w := request(srcHandler, http.MethodGet, "", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("export returned %d", w.Code)
+	}
+	export := w.Body.String()
+
+	dst := NewPasswordManager()
+	dstHandler := NewPasswordManagerHandler(dst)
+	dstHandler.AdminToken = []byte("secret")
+	if w := request(dstHandler, http.MethodPost, export, "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("import returned %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(dstHandler, http.MethodPost, export, "secret"); w.Code != http.StatusConflict {
+		t.Errorf("second import returned %d", w.Code)
+	}
+
+	if pwdHash, _ := dst.Get(0); !VerifyPassword("angryMonkey", pwdHash) {
+		t.Error("imported hash doesn't verify")
+	}
+	if _, state := dst.Get(1); state != TaskGone {
+		t.Errorf("retrieved hash has state %d after import", state)
+	}
+	if id := dst.Hash("angryMonkey"); id != 2 {
+		t.Errorf("new hash got id %d", id)
+	}
+
+	// the retrieved hash 1 isn't stored anymore, but its id was handed out
+	reused := `{"next_id": 2, "hashes": {"1": "` + base64.StdEncoding.EncodeToString([]byte{VersionBcrypt, 'x'}) + `"}}`
+	if w := request(dstHandler, http.MethodPost, reused, "secret"); w.Code != http.StatusConflict {
+		t.Errorf("import of a handed out id returned %d", w.Code)
+	}
+
+	huge := `{"next_id": 0, "hashes": {}, "padding": "` + strings.Repeat("a", MaxImportBytes) + `"}`
+	if w := request(dstHandler, http.MethodPost, huge, "secret"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized import returned %d", w.Code)
+	}
+}
+
+// Verifies that paths without an id are rejected instead of panicking
+func TestGetWithoutID(t *testing.T) {
+
+	pmh := NewPasswordManagerHandler(NewPasswordManager())
+	for _, path := range []string{"/hash", "/has", "/hash/"} {
+		w := httptest.NewRecorder()
+		pmh.get(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d", path, w.Code)
+		}
+	}
+}
+
+// Verifies that hashes and ids survive a restart with a file store, and that retrievals are persisted
+func TestFileStore(t *testing.T) {
+
+	path := t.TempDir() + "/hashes"
+	restart := func() (*PasswordManager, *FileStore) {
+		fs, err := OpenFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm := NewPasswordManager(WithNap(0))
+		if err := pm.Restore(fs); err != nil {
+			t.Fatal(err)
+		}
+		return pm, fs
+	}
+
+	pm, fs := restart()
+	pm.Hash("angryMonkey")
+	pm.Hash("angryMonkey2")
+	ts := time.Now()
+	for pm.HasPendingHashes() {
+		time.Sleep(10*time.Millisecond)
+		if time.Now().Sub(ts).Seconds() > 10 {
+			t.Fatal("hashes didn't complete in time")
+		}
+	}
+	pm.Get(1)
+	fs.Close()
+
+	pm, fs = restart()
+	if pwdHash, _ := pm.Get(0); !VerifyPassword("angryMonkey", pwdHash) {
+		t.Error("hash didn't survive the restart")
+	}
+	if _, state := pm.Get(1); state != TaskGone {
+		t.Errorf("retrieved hash has state %d after the restart", state)
+	}
+	if id := pm.Hash("angryMonkey"); id != 1+StoreReserveBlock { // the rest of the first block is skipped
+		t.Errorf("new hash got id %d", id)
+	}
+	fs.Close()
+
+	pm, fs = restart()
+	defer fs.Close()
+	if _, state := pm.Get(0); state != TaskGone {
+		t.Errorf("hash retrieved before the restart has state %d", state)
+	}
+	if id := pm.Hash("angryMonkey"); id <= 1+StoreReserveBlock {
+		t.Errorf("pending hash's id was handed out again: %d", id)
+	}
+}
+
+// Verifies that a record torn by a crash doesn't keep the store from being replayed after the next write
+//   - on the store itself, Restore would compact the torn record away
+func TestFileStoreTornRecord(t *testing.T) {
+
+	path := t.TempDir() + "/hashes"
+	load := func() (*FileStore, TaskExport) {
+		fs, err := OpenFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		export, err := fs.Load()
+		if err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		return fs, export
+	}
+
+	fs, _ := load()
+	fs.Put(0, []byte("hash0"), time.Time{})
+	fs.Close()
+
+	// crash in the middle of a write
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put","id":1,"hash":"YWJ`)
+	file.Close()
+
+	fs, _ = load()
+	fs.Put(2, []byte("hash2"), time.Time{})
+	fs.Close()
+
+	fs, export := load()
+	defer fs.Close()
+	if len(export.Hashes) != 2 || string(export.Hashes[0]) != "hash0" || string(export.Hashes[2]) != "hash2" {
+		t.Errorf("loaded %v", export.Hashes)
+	}
+}
+
+// Verifies that a restart keeps the expiry of the hashes and compacts the store
+func TestFileStoreCompact(t *testing.T) {
+
+	path := t.TempDir() + "/hashes"
+	fs, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := NewPasswordManager(WithNap(0), WithEntryTTL(1*time.Hour))
+	if err := pm.Restore(fs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		pm.Hash("angryMonkey")
+	}
+	<-waitIdle(pm)
+	for id := int64(1); id < 10; id++ {
+		pm.Get(id)
+	}
+	pm.Lock()
+	expiresAt := pm.tasks[0].expiresAt
+	pm.Unlock()
+	fs.Close()
+
+	fs, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	pm = NewPasswordManager(WithEntryTTL(1*time.Hour))
+	if err := pm.Restore(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	pm.Lock()
+	restored := pm.tasks[0].expiresAt
+	pm.Unlock()
+	if !restored.Equal(expiresAt) {
+		t.Errorf("expiry changed from %v to %v", expiresAt, restored)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 2 { // the remaining hash and the next id
+		t.Errorf("compacted store has %d records: %s", lines, content)
+	}
+}